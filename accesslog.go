@@ -0,0 +1,64 @@
+package akhttpd
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// spellchecker:words akhttpd slog
+
+// AccessLog is an http.Handler that logs every request served by Handler.
+type AccessLog struct {
+	Handler http.Handler
+	Logger  *slog.Logger
+
+	// Proxies are used to determine the ip address of clients.
+	Proxies TrustedProxies
+}
+
+// accessRecord holds details about a request for keys, filled in by the Handler.
+type accessRecord struct {
+	User      string // the requested username
+	Formatter string // name of the formatter used
+	Source    string // source of the keys returned by the repository
+	Keys      int    // number of keys returned
+}
+
+// accessRecordKey is the context key used to store an accessRecord
+type accessRecordKey struct{}
+
+// accessRecordFromContext returns the accessRecord stored in ctx, or nil.
+func accessRecordFromContext(ctx context.Context) *accessRecord {
+	record, _ := ctx.Value(accessRecordKey{}).(*accessRecord)
+	return record
+}
+
+// ServeHTTP serves r using Handler, and logs it once it is done.
+func (al AccessLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	record := new(accessRecord)
+	r = r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, record))
+
+	sw := &statusWriter{ResponseWriter: w}
+	al.Handler.ServeHTTP(sw, r)
+
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", sw.Status()),
+		slog.Duration("latency", time.Since(start)),
+		slog.String("client_ip", al.Proxies.ClientIP(r)),
+	}
+	if record.User != "" {
+		attrs = append(attrs,
+			slog.String("user", record.User),
+			slog.String("formatter", record.Formatter),
+			slog.String("source", record.Source),
+			slog.Int("keys", record.Keys),
+		)
+	}
+	al.Logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+}
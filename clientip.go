@@ -0,0 +1,104 @@
+package akhttpd
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// spellchecker:words akhttpd netip
+
+// TrustedProxies are the addresses of reverse proxies whose 'X-Forwarded-For' header is trusted.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses trusted proxies given as ip addresses or CIDR ranges.
+func ParseTrustedProxies(values []string) (TrustedProxies, error) {
+	networks, err := ParseNetworks(values)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid trusted proxy")
+	}
+	return TrustedProxies(networks), nil
+}
+
+// trusts checks if addr is a trusted proxy
+func (tp TrustedProxies) trusts(addr netip.Addr) bool {
+	return containsAddr(tp, addr)
+}
+
+// ParseNetworks parses networks given as ip addresses or CIDR ranges.
+// Empty values are ignored.
+func ParseNetworks(values []string) ([]netip.Prefix, error) {
+	networks := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			networks = append(networks, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, errors.Errorf("invalid network %q", value)
+		}
+		networks = append(networks, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return networks, nil
+}
+
+// containsAddr checks if any of networks contains addr
+func containsAddr(networks []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range networks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the ip address of the client that made r.
+//
+// When the request was made by a trusted proxy, the 'X-Forwarded-For' header is consulted.
+// The returned address is then the last address in it that is not a trusted proxy.
+// Requests received on a unix socket are assumed to be made by a trusted proxy.
+//
+// When the address can not be determined, returns an empty string.
+func (tp TrustedProxies) ClientIP(r *http.Request) string {
+	var client netip.Addr
+	trusted := true // unix sockets have no ip address
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			client = addr.Unmap()
+			trusted = tp.trusts(client)
+		}
+	}
+
+	// walk the forwarded addresses from the closest to the farthest hop
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; trusted && i >= 0; i-- {
+		value := strings.TrimSpace(forwarded[i])
+		if value == "" {
+			continue
+		}
+
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		trusted = tp.trusts(client)
+	}
+
+	if !client.IsValid() {
+		return ""
+	}
+	return client.String()
+}
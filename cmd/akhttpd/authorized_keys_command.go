@@ -0,0 +1,138 @@
+package main
+
+// spellchecker:words akhttpd sshd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tkw1536/akhttpd/pkg/client"
+)
+
+// authorizedKeysCommandName is the name of the authorized-keys-command subcommand
+const authorizedKeysCommandName = "authorized-keys-command"
+
+// validUpstreamName matches usernames that can be requested from an akhttpd server
+var validUpstreamName = regexp.MustCompile(`^[a-zA-Z\d@+-]+$`)
+
+// authorizedKeysCommand implements the authorized-keys-command subcommand.
+// It is intended to be used as AuthorizedKeysCommand in sshd_config.
+// It returns the exit code of the command.
+func authorizedKeysCommand(args []string) int {
+	flags := flag.NewFlagSet(authorizedKeysCommandName, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: akhttpd %s --server URL [flags] USER\n", authorizedKeysCommandName)
+		flags.PrintDefaults()
+	}
+
+	var c client.Client
+	var timeout = 5 * time.Second
+	var mapFile string
+	var mapping = make(mappingFlag)
+	var onlyMapped bool
+
+	flags.StringVar(&c.Server, "server", "", "url of the akhttpd server to fetch keys from")
+	flags.StringVar(&c.CacheDir, "cache-dir", "/var/cache/akhttpd", "directory to cache keys in, used when the server is unreachable. Empty to disable. ")
+	flags.DurationVar(&timeout, "timeout", timeout, "timeout for requests to the server")
+	flags.StringVar(&mapFile, "map-file", "", "optional file mapping unix accounts to upstream usernames, with one 'account username' pair per line")
+	flags.Var(mapping, "map", "map a unix account to an upstream username as 'account=username' (may be repeated)")
+	flags.BoolVar(&onlyMapped, "only-mapped", false, "only fetch keys for unix accounts that have been explicitly mapped")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if c.Server == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	if mapFile != "" {
+		if err := mapping.ReadFile(mapFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	// determine the upstream user to fetch keys for
+	account := flags.Arg(0)
+	username, ok := mapping[account]
+	if !ok {
+		if onlyMapped {
+			return 0
+		}
+		username = account
+	}
+	if !validUpstreamName.MatchString(username) {
+		return 0
+	}
+
+	// and fetch them
+	c.Client = &http.Client{Timeout: timeout}
+	keys, cached, err := c.Fetch(context.Background(), username)
+	if errors.Is(err, client.ErrUserNotFound) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to fetch keys for %q: %s\n", username, err)
+		return 1
+	}
+	if cached {
+		fmt.Fprintf(os.Stderr, "server unreachable, using cached keys for %q\n", username)
+	}
+
+	os.Stdout.Write(keys)
+	return 0
+}
+
+// mappingFlag is a flag.Value mapping unix accounts to upstream usernames
+type mappingFlag map[string]string
+
+func (mf mappingFlag) String() string {
+	pairs := make([]string, 0, len(mf))
+	for account, username := range mf {
+		pairs = append(pairs, account+"="+username)
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (mf mappingFlag) Set(value string) error {
+	account, username, ok := strings.Cut(value, "=")
+	if !ok || account == "" || username == "" {
+		return fmt.Errorf("mapping %q is not of the form 'account=username'", value)
+	}
+	mf[account] = username
+	return nil
+}
+
+// ReadFile reads mappings from the provided file.
+// Each non-empty line not starting with '#' is of the form 'account username'.
+func (mf mappingFlag) ReadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s: line %q is not of the form 'account username'", path, line)
+		}
+		mf[fields[0]] = fields[1]
+	}
+	return scanner.Err()
+}
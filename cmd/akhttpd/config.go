@@ -0,0 +1,314 @@
+package main
+
+// spellchecker:words akhttpd akpath gitea yaml
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tkw1536/akhttpd/pkg/format"
+	"github.com/tkw1536/akhttpd/pkg/repo"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of akhttpd.
+//
+// It is read from (in increasing order of precedence) the defaults, environment variables, the configuration file and command line flags.
+// See the package documentation for details on each option.
+type Config struct {
+	Listen string       `yaml:"listen"` // address to listen on, 'host:port' or 'unix:/path/to/socket'
+	Server ServerConfig `yaml:"server"`
+
+	GitHub UpstreamConfig `yaml:"github"`
+	GitLab UpstreamConfig `yaml:"gitlab"`
+	Gitea  UpstreamConfig `yaml:"gitea"`
+	AKPath string         `yaml:"akpath"` // path to check for authorized_keys files
+
+	Cache CacheConfig `yaml:"cache"`
+
+	APITimeout      time.Duration `yaml:"api_timeout"`
+	RequestTimeout  time.Duration `yaml:"request_timeout"`
+	StaleMaxAge     time.Duration `yaml:"stale_max_age"`
+	StaleMaxEntries int           `yaml:"stale_max_entries"`
+
+	Blocked   []string            `yaml:"blocked"`    // users blocked for legal reasons
+	Teams     map[string][]string `yaml:"teams"`      // teams served under '/team/'
+	KeyPolicy string              `yaml:"key_policy"` // policy to filter keys with, in query string syntax
+
+	Formatters FormattersConfig `yaml:"formatters"`
+
+	Index  string `yaml:"index"`  // path to serve '/' from
+	Suffix string `yaml:"suffix"` // path to append to html responses
+	Serve  string `yaml:"serve"`  // path to serve '/_/' from
+
+	Metrics bool `yaml:"metrics"` // serve '/_/metrics'
+
+	Uploads UploadsConfig `yaml:"uploads"`
+
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	Log LogConfig `yaml:"log"`
+}
+
+// ServerConfig configures the http server
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"` // maximum time to wait for requests to finish when shutting down
+
+	TLSCert string `yaml:"tls_cert"` // certificate file to serve https with
+	TLSKey  string `yaml:"tls_key"`  // private key file to serve https with
+}
+
+// UpstreamConfig configures an upstream API to fetch keys from
+type UpstreamConfig struct {
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+}
+
+// CacheConfig configures the cache for upstream API responses
+type CacheConfig struct {
+	Size    int64         `yaml:"size"`     // maximum in-memory size in bytes
+	Age     time.Duration `yaml:"age"`      // maximum age of entries
+	Dir     string        `yaml:"dir"`      // directory to cache in instead of memory
+	DirSize int64         `yaml:"dir_size"` // maximum on-disk size in bytes
+}
+
+// FormattersConfig configures the formatters
+type FormattersConfig struct {
+	KeyOptions        string   `yaml:"key_options"`         // options to prepend to every key
+	AllowedKeyOptions []string `yaml:"allowed_key_options"` // options clients may request
+
+	SignersPrincipal   string `yaml:"signers_principal"`    // template for allowed_signers principals
+	SignersSigningKeys bool   `yaml:"signers_signing_keys"` // use signing keys in allowed_signers
+}
+
+// UploadsConfig configures user uploads
+type UploadsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Auth    string `yaml:"auth"` // 'username:password' to protect uploads with
+
+	Store        string        `yaml:"store"`          // file to keep persistent uploads in
+	MaxTTL       time.Duration `yaml:"max_ttl"`        // maximum time to keep persistent uploads for
+	MaxCount     int           `yaml:"max_count"`      // maximum number of persistent uploads
+	MaxPerClient int           `yaml:"max_per_client"` // maximum number of persistent uploads per client
+}
+
+// RateLimitConfig configures the per-client rate limit
+type RateLimitConfig struct {
+	Rate       float64  `yaml:"rate"`        // requests per second, 0 to disable
+	Burst      int      `yaml:"burst"`       // requests at once
+	IPv4Prefix int      `yaml:"ipv4_prefix"` // prefix length of ipv4 networks sharing a limit
+	IPv6Prefix int      `yaml:"ipv6_prefix"` // prefix length of ipv6 networks sharing a limit
+	Allowed    []string `yaml:"allowed"`     // networks that are not limited
+}
+
+// LogConfig configures logging
+type LogConfig struct {
+	Format string `yaml:"format"` // "text" or "json"
+	Access string `yaml:"access"` // destination of the access log, "-" for standard error
+	Audit  string `yaml:"audit"`  // destination of the audit log, "-" for standard error
+
+	TrustedProxies []string `yaml:"trusted_proxies"` // proxies whose 'X-Forwarded-For' header is trusted
+}
+
+// defaultConfig returns the default configuration, taking into account environment variables
+func defaultConfig() Config {
+	config := Config{
+		Listen: "localhost:8080",
+		Server: ServerConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+		},
+
+		GitHub: UpstreamConfig{URL: os.Getenv("GITHUB_URL"), Token: os.Getenv("GITHUB_TOKEN")},
+		GitLab: UpstreamConfig{URL: os.Getenv("GITLAB_URL"), Token: os.Getenv("GITLAB_TOKEN")},
+		Gitea:  UpstreamConfig{URL: os.Getenv("GITEA_URL"), Token: os.Getenv("GITEA_TOKEN")},
+
+		Cache: CacheConfig{
+			Size:    25 * 1000,
+			Age:     1 * time.Hour,
+			DirSize: 10 * 1000 * 1000,
+		},
+
+		APITimeout:      1 * time.Second,
+		StaleMaxAge:     24 * time.Hour,
+		StaleMaxEntries: repo.DefaultStaleMaxEntries,
+
+		Teams: make(map[string][]string),
+
+		Formatters: FormattersConfig{
+			AllowedKeyOptions:  slices.Clone(format.RestrictiveOptions),
+			SignersPrincipal:   "{{.User}}",
+			SignersSigningKeys: true,
+		},
+
+		Uploads: UploadsConfig{
+			Auth:         os.Getenv("UPLOAD_AUTH"),
+			MaxTTL:       7 * 24 * time.Hour,
+			MaxCount:     repo.DefaultMaxPersistentUploads,
+			MaxPerClient: repo.DefaultMaxPersistentUploadsPerClient,
+		},
+
+		RateLimit: RateLimitConfig{
+			Burst:      10,
+			IPv4Prefix: 32,
+			IPv6Prefix: 64,
+		},
+
+		Log: LogConfig{Format: "text"},
+	}
+	if blocked := os.Getenv("LEGAL_BLOCK"); blocked != "" {
+		config.Blocked = strings.Split(blocked, ",")
+	}
+	config.Uploads.Enabled = config.Uploads.Auth != ""
+	return config
+}
+
+// loadConfig loads the configuration.
+// It reads the defaults, the configuration file at path (if non-empty), and then the command line flags in args.
+func loadConfig(path string, args []string) (Config, error) {
+	config := defaultConfig()
+
+	if path != "" {
+		if err := config.readFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+	if config.Teams == nil {
+		config.Teams = make(map[string][]string)
+	}
+
+	// command line flags take precedence over the file
+	flags := flag.NewFlagSet("akhttpd", flag.ContinueOnError)
+	flags.Usage = func() {}
+	config.bindFlags(flags)
+	flags.String("config", "", "")
+	flags.Bool("legal", false, "")
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if flags.NArg() == 1 {
+		config.Listen = flags.Arg(0)
+	}
+
+	return config, nil
+}
+
+// readFile reads the yaml configuration file at path into config.
+// Options not contained in the file are left unchanged.
+func (config *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open configuration file")
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return errors.Wrapf(err, "failed to read configuration file %q", path)
+	}
+	return nil
+}
+
+// bindFlags binds command line flags to the options in config.
+// The current values of config are used as defaults.
+func (config *Config) bindFlags(flags *flag.FlagSet) {
+	flags.DurationVar(&config.Server.ReadHeaderTimeout, "read-header-timeout", config.Server.ReadHeaderTimeout, "maximum time to read the headers of a request, 0 to disable")
+	flags.DurationVar(&config.Server.ReadTimeout, "read-timeout", config.Server.ReadTimeout, "maximum time to read an entire request, 0 to disable")
+	flags.DurationVar(&config.Server.WriteTimeout, "write-timeout", config.Server.WriteTimeout, "maximum time to write a response, 0 to disable")
+	flags.DurationVar(&config.Server.IdleTimeout, "idle-timeout", config.Server.IdleTimeout, "maximum time to keep idle connections open, 0 to disable")
+	flags.StringVar(&config.Server.TLSCert, "tls-cert", config.Server.TLSCert, "optional certificate file to serve https with, reloaded when changed")
+	flags.StringVar(&config.Server.TLSKey, "tls-key", config.Server.TLSKey, "optional private key file to serve https with, reloaded when changed")
+	flags.DurationVar(&config.Server.ShutdownTimeout, "shutdown-timeout", config.Server.ShutdownTimeout, "maximum time to wait for requests and upload sessions to finish when shutting down")
+	flags.StringVar(&config.GitHub.Token, "token", config.GitHub.Token, "token for github authentication (can also be set by 'GITHUB_TOKEN' variable). ")
+	flags.StringVar(&config.GitHub.URL, "github-url", config.GitHub.URL, "optional url of a GitHub Enterprise Server to use instead of github.com (can also be set by 'GITHUB_URL' variable). ")
+	flags.StringVar(&config.GitLab.URL, "gitlab-url", config.GitLab.URL, "optional url of a GitLab instance to check for public keys before GitHub (can also be set by 'GITLAB_URL' variable). ")
+	flags.StringVar(&config.GitLab.Token, "gitlab-token", config.GitLab.Token, "token for gitlab authentication (can also be set by 'GITLAB_TOKEN' variable). ")
+	flags.StringVar(&config.Gitea.URL, "gitea-url", config.Gitea.URL, "optional url of a Gitea or Forgejo instance to check for public keys before GitHub (can also be set by 'GITEA_URL' variable). ")
+	flags.StringVar(&config.Gitea.Token, "gitea-token", config.Gitea.Token, "token for gitea authentication (can also be set by 'GITEA_TOKEN' variable). ")
+	flags.Int64Var(&config.Cache.Size, "cache-size", config.Cache.Size, "maximum in-memory cache size in bytes")
+	flags.StringVar(&config.Cache.Dir, "cache-dir", config.Cache.Dir, "optional directory to cache upstream responses in, instead of in memory")
+	flags.Int64Var(&config.Cache.DirSize, "cache-dir-size", config.Cache.DirSize, "maximum size of the on-disk cache in bytes")
+	flags.DurationVar(&config.Cache.Age, "cache-age", config.Cache.Age, "maximum time after which cache entries should expire")
+	flags.DurationVar(&config.APITimeout, "api-timeout", config.APITimeout, "timeout for github API connection")
+	flags.DurationVar(&config.StaleMaxAge, "stale-max-age", config.StaleMaxAge, "maximum age of keys served when the upstream fails, 0 to disable")
+	flags.IntVar(&config.StaleMaxEntries, "stale-max-entries", config.StaleMaxEntries, "maximum number of sets of keys remembered for when the upstream fails")
+	flags.DurationVar(&config.RequestTimeout, "request-timeout", config.RequestTimeout, "maximum time to spend resolving keys for a single request, 0 to disable")
+	flags.StringVar(&config.Formatters.SignersPrincipal, "signers-principal", config.Formatters.SignersPrincipal, "template for the principal used in allowed_signers files, e.g. '{{.User}}@example.com'")
+	flags.BoolVar(&config.Formatters.SignersSigningKeys, "signers-signing-keys", config.Formatters.SignersSigningKeys, "use GitHub ssh signing keys instead of authentication keys in allowed_signers files")
+	flags.StringVar(&config.KeyPolicy, "key-policy", config.KeyPolicy, "policy to filter all served keys with, e.g. 'exclude=dsa&min-rsa-bits=2048'")
+	flags.StringVar(&config.Formatters.KeyOptions, "key-options", config.Formatters.KeyOptions, "authorized_keys options to prepend to every served key, e.g. 'restrict,from=\"10.0.0.0/8\"'")
+	flags.Var((*listFlag)(&config.Formatters.AllowedKeyOptions), "allowed-key-options", "comma-separated names of authorized_keys options clients may request using '?options='")
+	flags.Var(teamsFlag(config.Teams), "team", "define a team as 'name=user1,user2' to serve under '/team/name' (may be repeated)")
+	flags.StringVar(&config.Index, "index", config.Index, "optional path to '/' serve. Assumed to be of mime-type html. ")
+	flags.StringVar(&config.Suffix, "suffix", config.Suffix, "optional path to append to all html responses. Assumed to be of mime-type html. ")
+	flags.StringVar(&config.Serve, "serve", config.Serve, "optional path to '_' static directory to serve. ")
+	flags.StringVar(&config.AKPath, "akpath", config.AKPath, "optional path to check for additional authorized keys files")
+	flags.BoolVar(&config.Metrics, "metrics", config.Metrics, "serve metrics in Prometheus text format on '/_/metrics'")
+	flags.BoolVar(&config.Uploads.Enabled, "allow-uploads", config.Uploads.Enabled, "serve the '/_/upload/' path to allow users to temporarily upload their own keys")
+	flags.StringVar(&config.Uploads.Auth, "upload-auth", config.Uploads.Auth, "Protect '/_/upload/' with a 'username:password' combination")
+	flags.StringVar(&config.Uploads.Store, "upload-store", config.Uploads.Store, "optional file to keep uploads in, allowing users to upload keys for a limited time")
+	flags.DurationVar(&config.Uploads.MaxTTL, "upload-max-ttl", config.Uploads.MaxTTL, "maximum time to keep uploads in the upload store for, 0 for no maximum")
+	flags.IntVar(&config.Uploads.MaxCount, "upload-max-count", config.Uploads.MaxCount, "maximum number of uploads kept for a limited time")
+	flags.IntVar(&config.Uploads.MaxPerClient, "upload-max-per-client", config.Uploads.MaxPerClient, "maximum number of uploads kept for a limited time per client")
+	flags.Float64Var(&config.RateLimit.Rate, "rate-limit", config.RateLimit.Rate, "number of requests for keys per second each client may make on average, 0 to disable")
+	flags.IntVar(&config.RateLimit.Burst, "rate-limit-burst", config.RateLimit.Burst, "number of requests for keys each client may make at once")
+	flags.IntVar(&config.RateLimit.IPv4Prefix, "rate-limit-ipv4-prefix", config.RateLimit.IPv4Prefix, "prefix length of ipv4 networks sharing a rate limit")
+	flags.IntVar(&config.RateLimit.IPv6Prefix, "rate-limit-ipv6-prefix", config.RateLimit.IPv6Prefix, "prefix length of ipv6 networks sharing a rate limit")
+	flags.Var((*listFlag)(&config.RateLimit.Allowed), "rate-limit-allow", "comma-separated addresses or CIDR ranges of clients that are not rate limited")
+	flags.StringVar(&config.Log.Format, "log-format", config.Log.Format, "format of all logs, 'text' or 'json'")
+	flags.StringVar(&config.Log.Access, "access-log", config.Log.Access, "optional file to write access logs to, '-' for standard error")
+	flags.StringVar(&config.Log.Audit, "audit-log", config.Log.Audit, "optional file to write upload audit logs to, '-' for standard error")
+	flags.Var((*listFlag)(&config.Log.TrustedProxies), "trusted-proxies", "comma-separated addresses or CIDR ranges of proxies whose 'X-Forwarded-For' header is trusted")
+}
+
+// listFlag is a flag.Value holding a comma-separated list
+type listFlag []string
+
+func (lf *listFlag) String() string {
+	if lf == nil {
+		return ""
+	}
+	return strings.Join(*lf, ",")
+}
+
+func (lf *listFlag) Set(value string) error {
+	if value == "" {
+		*lf = nil
+		return nil
+	}
+	*lf = strings.Split(value, ",")
+	return nil
+}
+
+// teamsFlag is a flag.Value holding team definitions of the form 'name=user1,user2'
+type teamsFlag map[string][]string
+
+func (tf teamsFlag) String() string {
+	teams := make([]string, 0, len(tf))
+	for name, members := range tf {
+		teams = append(teams, name+"="+strings.Join(members, ","))
+	}
+	return strings.Join(teams, " ")
+}
+
+func (tf teamsFlag) Set(value string) error {
+	name, members, ok := strings.Cut(value, "=")
+	if !ok || name == "" || members == "" {
+		return fmt.Errorf("team %q is not of the form 'name=user1,user2'", value)
+	}
+	tf[name] = strings.Split(members, ",")
+	return nil
+}
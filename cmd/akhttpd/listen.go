@@ -0,0 +1,140 @@
+package main
+
+// spellchecker:words akhttpd systemd fds
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// listen creates a listener for the given address.
+//
+// When the process was started using systemd socket activation, the address is ignored and the first passed socket is used instead.
+// An address of the form 'unix:/path/to/socket' listens on a unix socket, replacing any existing socket.
+// Any other address is treated as a tcp 'host:port'.
+func listen(address string) (net.Listener, error) {
+	if listener, err := systemdListener(); listener != nil || err != nil {
+		return listener, err
+	}
+
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		// remove a socket left behind by a previous instance
+		if info, err := os.Stat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// systemdFirstFD is the first file descriptor passed using systemd socket activation
+const systemdFirstFD = 3
+
+// systemdListener returns the first listener passed using systemd socket activation, see sd_listen_fds(3).
+// When no sockets were passed to this process, returns nil.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+
+	// do not pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(systemdFirstFD, "LISTEN_FD_"+strconv.Itoa(systemdFirstFD))
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid socket passed by systemd")
+	}
+	return listener, nil
+}
+
+// listenerName returns a human-readable description of listener
+func listenerName(listener net.Listener) string {
+	addr := listener.Addr()
+	if addr.Network() == "tcp" {
+		return addr.String()
+	}
+	return fmt.Sprintf("%s:%s", addr.Network(), addr.String())
+}
+
+// certificateReloader provides a tls certificate loaded from a pair of files.
+// The certificate is reloaded whenever either file changes.
+type certificateReloader struct {
+	certFile, keyFile string
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of either file when cert was loaded
+}
+
+// newCertificateReloader creates a new certificateReloader, and loads the certificate.
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	cr := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate returns the current certificate.
+// It is intended to be used as tls.Config.GetCertificate.
+//
+// When reloading a changed certificate fails, the previous certificate is returned.
+func (cr *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	modTime, err := cr.latestModTime()
+	if err != nil && cr.cert == nil {
+		return nil, err
+	}
+	if err != nil || modTime.Equal(cr.modTime) {
+		return cr.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		if cr.cert == nil {
+			return nil, errors.Wrap(err, "failed to load tls certificate")
+		}
+		return cr.cert, nil
+	}
+
+	cr.cert = &cert
+	cr.modTime = modTime
+	return cr.cert, nil
+}
+
+// latestModTime returns the latest modification time of the certificate and key files
+func (cr *certificateReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
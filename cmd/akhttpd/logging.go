@@ -0,0 +1,49 @@
+package main
+
+// spellchecker:words akhttpd slog
+
+import (
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// newLogHandler creates a new slog.Handler writing to w in the given format.
+// Format is either "text" or "json".
+func newLogHandler(w io.Writer, format string) (slog.Handler, error) {
+	switch format {
+	case "text", "":
+		return slog.NewTextHandler(w, nil), nil
+	case "json":
+		return slog.NewJSONHandler(w, nil), nil
+	default:
+		return nil, errors.Errorf("unknown log format %q", format)
+	}
+}
+
+// newLogger creates a new logger writing to the given destination in the given format.
+//
+// The destination "-" refers to standard error, any other non-empty destination is a file that is appended to.
+// When the destination is empty, returns nil.
+func newLogger(destination, format string) (*slog.Logger, error) {
+	if destination == "" {
+		return nil, nil
+	}
+
+	var w io.Writer = os.Stderr
+	if destination != "-" {
+		f, err := os.OpenFile(destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open log file")
+		}
+		w = f
+	}
+
+	handler, err := newLogHandler(w, format)
+	if err != nil {
+		return nil, err
+	}
+	return slog.New(handler), nil
+}
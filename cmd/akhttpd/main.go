@@ -20,6 +20,7 @@
 // Returns an authorized_keys file for the provided username.
 // When successful, returns HTTP 200 along with appropriate Content-Disposition and Content-Type Headers.
 // When the user does not exist, returns HTTP 404.
+// When fetching the keys times out, returns HTTP 504.
 // When something goes wrong, returns HTTP 500.
 //
 //	GET /${username}.html
@@ -41,6 +42,45 @@
 // When the user does not exist, returns HTTP 404.
 // When something goes wrong, returns HTTP 500.
 //
+//	GET /${username}.json
+//
+// Returns a json document containing the keys for the provided username.
+// Next to the username, the source, and the generation time, it contains an array of keys.
+// Each key contains its type, base64-encoded blob, comment, size in bits and SHA256 and MD5 fingerprints.
+// When the user does not exist, returns HTTP 404.
+// When something goes wrong, returns HTTP 500.
+//
+//	GET /${username}.allowed_signers
+//
+// Returns an OpenSSH allowed_signers file for the provided username.
+// It can be used to verify ssh signatures, for example using git's 'gpg.ssh.allowedSignersFile' setting.
+// Each line is of the form '${principal} namespaces="git" ${key}'.
+// When successful, returns HTTP 200 along with appropriate Content-Disposition and Content-Type Headers.
+// When the user does not exist, returns HTTP 404.
+// When something goes wrong, returns HTTP 500.
+//
+// All of the above can be filtered using the query parameters 'type', 'exclude' and 'min-rsa-bits'.
+// For example, '/${username}?type=ed25519,ecdsa' only returns ed25519 and ecdsa keys, '?exclude=dsa' removes all dsa keys, and '?min-rsa-bits=3072' removes rsa keys shorter than 3072 bits.
+// The html page reports keys that were removed.
+// When these parameters are invalid, returns HTTP 400.
+//
+// The authorized_keys and shell script formats additionally accept an 'options' query parameter.
+// It contains authorized_keys options to prepend to every key, e.g. '?options=restrict,from="10.0.0.0/8"'.
+// By default, only options restricting what a key can be used for are allowed, see the -allowed-key-options flag.
+// When these options are invalid or not allowed, returns HTTP 400.
+//
+//	GET /${username1}+${username2}+...
+//	GET /team/${name}
+//
+// Returns the merged keys of several users, or of all members of a team configured using the -team flag.
+// All of the above formats are supported, e.g. '/alice+bob.sh' or '/team/oncall/authorized_keys'.
+// Identical keys are only returned once, and each key is annotated with the user it belongs to.
+// When any of the users or the team do not exist, returns HTTP 404.
+//
+// All of the above also answer HEAD requests, and include an ETag header computed from the returned keys.
+// When the ETag matches the If-None-Match header of the request, returns HTTP 304 Not Modified.
+// When the optional per-client rate limit is exceeded, returns HTTP 429 with a Retry-After header.
+//
 //	GET /robots.txt
 //
 // Returns a robots.txt file.
@@ -52,16 +92,157 @@
 //	GET /_/upload/
 //
 // Optionally serves an interface for user uploads.
+// Uploaded keys are served under a random username for as long as the page stays open, or optionally for a limited time (see -upload-store).
+// To prove that they own them, users have to sign a random challenge using every uploaded key, with a command like:
+//
+//	printf '%s' 'challenge' | ssh-keygen -Y sign -n akhttpd -f ~/.ssh/id_ed25519
+//
+//	GET /_/upload/api, POST /_/upload/api, PUT /_/upload/api, DELETE /_/upload/api
+//
+// Optionally serves a plain http api for user uploads, for scripts that can not keep the upload page open.
+// GET returns a json object with a new challenge, valid for 5 minutes.
+// POST uploads keys, using the form values 'keys' (in authorized_keys format), 'challenge', 'signature' and 'ttl' (in seconds, by default one hour).
+// It returns HTTP 201 and a json object with the username, the time the keys expire and a token.
+// PUT extends the upload to expire after the 'ttl' form value, and DELETE removes it immediately.
+// Both require the token in an 'Authorization: Bearer' header, but not the -upload-auth credentials.
+// For example:
+//
+//	challenge=$(curl -s http://localhost:8080/_/upload/api | jq -r .challenge)
+//	printf '%s' "$challenge" | ssh-keygen -Y sign -n akhttpd -f ~/.ssh/id_ed25519 > signature
+//	curl -F keys=@.ssh/id_ed25519.pub -F challenge=$challenge -F signature=@signature -F ttl=3600 http://localhost:8080/_/upload/api
+//
+//	GET /_/status
+//
+// Returns the state of upstream APIs as json, such as the remaining GitHub API rate limit and the time it resets.
+// Once the GitHub API rate limit is exhausted, only cached keys are served, and requests for other users return HTTP 503.
+//
+//	GET /_/healthz, GET /_/readyz
+//
+// Liveness and readiness probes, e.g. for use with Kubernetes.
+// The former always returns HTTP 200.
+// The latter returns HTTP 200 only if all upstream APIs are reachable, and HTTP 503 otherwise or when akhttpd is shutting down.
+//
+//	GET /_/metrics
+//
+// Optionally serves metrics in the Prometheus text format.
+// These include the number of requests by formatter, status and source, the latency of upstream API requests,
+// the number of upstream responses served from cache, and the number of active upload sessions.
+//
+// # AuthorizedKeysCommand
+//
+// Next to the daemon itself, akhttpd provides a subcommand for use as 'AuthorizedKeysCommand' in sshd_config.
+// It fetches keys for a unix account from an akhttpd server, and can be configured like:
+//
+//	AuthorizedKeysCommand /usr/local/bin/akhttpd authorized-keys-command --server https://akhttpd.example.com/ %u
+//	AuthorizedKeysCommandUser nobody
+//
+// Every successful response is cached on disk, by default in '/var/cache/akhttpd' (see the '--cache-dir' flag).
+// When the server is unreachable, the cached keys are served instead.
+// Unix accounts can be mapped to upstream usernames using '--map account=username' or a '--map-file'.
+// Use '--only-mapped' to not fetch keys for unmapped accounts, such as root.
+// Run 'akhttpd authorized-keys-command -help' for a list of all flags.
 //
 // # Configuration
 //
 // akhttpd can be configured using an environment variable as well as command line arguments.
 //
+//	-config path
+//
+// All options below can also be given in a yaml configuration file.
+// Options given on the command line take precedence over those in the file, which in turn take precedence over environment variables.
+// An example file looks like:
+//
+//	listen: localhost:8080
+//	server:
+//	  read_header_timeout: 10s
+//	  read_timeout: 30s
+//	  write_timeout: 30s
+//	  idle_timeout: 2m
+//	  shutdown_timeout: 30s
+//	  tls_cert: /etc/akhttpd/cert.pem
+//	  tls_key: /etc/akhttpd/key.pem
+//	github:
+//	  url: https://github.example.com/
+//	  token: my-super-secret-token
+//	gitlab:
+//	  url: https://gitlab.example.com/
+//	gitea:
+//	  url: https://gitea.example.com/
+//	akpath: /keys
+//	cache:
+//	  size: 25000
+//	  age: 1h
+//	  dir: /var/cache/akhttpd
+//	  dir_size: 10000000
+//	api_timeout: 1s
+//	request_timeout: 5s
+//	stale_max_age: 24h
+//	stale_max_entries: 10000
+//	blocked: [user1, user2]
+//	teams:
+//	  ops: [user1, user2]
+//	key_policy: exclude=dsa&min-rsa-bits=2048
+//	formatters:
+//	  key_options: restrict
+//	  allowed_key_options: [from, expiry-time]
+//	  signers_principal: "{{.User}}@example.com"
+//	  signers_signing_keys: true
+//	index: /path/to/index.html
+//	suffix: /path/to/suffix.html
+//	serve: /path/to/underscore
+//	metrics: true
+//	uploads:
+//	  enabled: true
+//	  auth: username:password
+//	  store: /var/lib/akhttpd/uploads.json
+//	  max_ttl: 168h
+//	  max_count: 1000
+//	  max_per_client: 10
+//	rate_limit:
+//	  rate: 1
+//	  burst: 10
+//	  allowed: [10.0.0.0/8]
+//	log:
+//	  format: json
+//	  access: /var/log/akhttpd/access.log
+//	  audit: /var/log/akhttpd/audit.log
+//	  trusted_proxies: [127.0.0.1, 10.0.0.0/8]
+//
+// When akhttpd receives SIGHUP, the configuration file is read again and the new configuration is applied to all new requests.
+// Requests that are in progress finish using the old configuration.
+// Changes to the listen address, the server options, the cache, uploads and logging only take effect after a restart.
+// An invalid configuration is rejected as a whole, and the previous configuration stays in effect.
+// Stale keys and rate limits are kept, unless the respective upstreams or limits change.
+//
 //	host:port
 //
 // By default akhttpd listens on localhost, port 8080 only.
 // To change this, pass an argument of the form 'host:port' to the akhttpd command.
 //
+//	unix:/path/to/socket
+//
+// To instead listen on a unix socket, e.g. behind a reverse proxy, pass an argument of the form 'unix:/path/to/socket'.
+// Any existing socket at this path is replaced.
+//
+// When akhttpd is started using systemd socket activation (i.e. with the LISTEN_PID and LISTEN_FDS variables set), it instead listens on the first passed socket.
+//
+//	-tls-cert file, -tls-key file
+//
+// Serve https using the given certificate and private key files.
+// Both files are reloaded whenever either of them changes, e.g. when the certificate is renewed.
+//
+//	-read-header-timeout duration, -read-timeout duration, -write-timeout duration, -idle-timeout duration
+//
+// Configure the timeouts of the http server, see the documentation of net/http.Server.
+// They default to 10s, 30s, 30s and 2m respectively.
+// Upload sessions are not subject to these timeouts.
+//
+//	-shutdown-timeout duration
+//
+// On SIGTERM or SIGINT, akhttpd stops accepting new connections and waits for requests in progress to finish.
+// Upload sessions are closed, and their keys removed.
+// After this timeout, by default 30s, all remaining connections are closed.
+//
 //	GITHUB_TOKEN=token, -token TOKEN
 //
 // akhttpd interacts with the GitHub API.
@@ -70,23 +251,99 @@
 // It does not need access to any Scopes.
 // It should be provided using either the GITHUB_TOKEN environment variable or the -token flag.
 //
+//	GITHUB_URL=url, -github-url URL
+//
+// By default akhttpd uses the public GitHub API at api.github.com.
+// To instead use a GitHub Enterprise Server, provide its url (e.g. https://github.example.com/) using either the GITHUB_URL environment variable or the -github-url flag.
+// The html pages then link to user profiles on that server.
+//
+//	GITLAB_URL=url, -gitlab-url URL, GITLAB_TOKEN=token, -gitlab-token TOKEN
+//
+// akhttpd can optionally interact with the API of a (self-managed) GitLab instance.
+// To enable this, provide the url of the instance using either the GITLAB_URL environment variable or the -gitlab-url flag.
+// Users are then first looked up on GitLab, and only if they do not exist there on GitHub.
+// By default, this interaction is unauthenticated.
+// Instead a GitLab Personal Access Token with the 'read_api' scope can be used.
+// It should be provided using either the GITLAB_TOKEN environment variable or the -gitlab-token flag.
+//
+//	GITEA_URL=url, -gitea-url URL, GITEA_TOKEN=token, -gitea-token TOKEN
+//
+// akhttpd can optionally interact with the API of a Gitea or Forgejo instance.
+// To enable this, provide the url of the instance using either the GITEA_URL environment variable or the -gitea-url flag.
+// Users are then looked up on Gitea after GitLab (if configured), but before GitHub.
+// By default, this interaction is unauthenticated.
+// Instead an access token with the 'read:user' scope can be used.
+// It should be provided using either the GITEA_TOKEN environment variable or the -gitea-token flag.
+//
 //	-api-timeout duration
 //
-// When interacting with the GitHub API, akhttpd uses a default timeout of 1s.
-// After this timeout expires, any response is considered invalid and an HTTP 500 is returned to the client.
+// When interacting with the GitHub, GitLab or Gitea API, akhttpd uses a default timeout of 1s.
+// After this timeout expires, any response is considered invalid and an HTTP 504 is returned to the client.
 // Use this flag to change the default timeout.
 //
+//	-request-timeout duration
+//
+// In addition, the total time spent resolving keys for a single request can be limited.
+// After this deadline expires, or when the client disconnects, any pending upstream requests are cancelled and an HTTP 504 is returned.
+// By default, no such deadline is set.
+//
+//	-stale-max-age duration
+//
+// When an upstream API fails or times out, akhttpd serves the keys it last successfully returned for the user instead.
+// Such responses carry a 'Warning' header, and html pages show a banner.
+// Keys are served this way for at most 24h after they were last fetched, use this flag to change the default.
+// Use '-stale-max-age 0' to disable this behavior.
+//
+//	-stale-max-entries count
+//
+// At most 10000 sets of keys are remembered, after which the least recently used ones are forgotten.
+//
 //	-cache-age duration, -cache-size bytes
 //
-// To avoid unnecessary GitHub API requests, akhttpd caches responses.
+// To avoid unnecessary GitHub, GitLab or Gitea API requests, akhttpd caches responses.
 // Responses are cached for 1h by default, with a maximum cache size of 25kb.
+// Concurrent requests for the keys of the same user are in addition coalesced into a single API request.
+//
+//	-cache-dir path, -cache-dir-size bytes
+//
+// By default, the cache is kept in memory, and lost whenever akhttpd restarts.
+// Use -cache-dir to instead cache responses in the given directory, with a maximum size of 10MB by default.
+// The directory can be shared with the '--cache-dir' of the 'authorized-keys-command' subcommand.
+// Responses are kept in its 'upstream' subdirectory, and only these count towards the maximum size.
 // Use these flags to change the defaults.
 //
 //	-akpath path
 //
-// Before querying the GitHub API for a users' public keys first check this path on the filesystem.
+// Before querying the GitLab, Gitea or GitHub API for a users' public keys first check this path on the filesystem.
 // If a file corresponding to a requested username exists, treat that file as an 'authorized_keys' file
 // and return only keys stored in there.
+// Any options and comments of keys in these files are preserved.
+//
+//	-signers-principal template, -signers-signing-keys
+//
+// The principal used in allowed_signers files is generated using a go template.
+// It receives the requested username as {{.User}} and the source of the user as {{.Source}}.
+// The default is '{{.User}}', but something like '{{.User}}@example.com' may be appropriate.
+// By default, allowed_signers files for GitHub users contain their ssh signing keys, not their authentication keys.
+// Use '-signers-signing-keys=false' to change this.
+//
+//	-key-policy policy
+//
+// Filters all keys served by akhttpd using the given policy.
+// The policy uses the same syntax as the query parameters above, e.g. 'exclude=dsa&min-rsa-bits=2048' drops all dsa keys and short rsa keys.
+// Clients can further restrict, but never relax, this policy.
+//
+//	-key-options options, -allowed-key-options option1,option2
+//
+// Prepends the given authorized_keys options (e.g. 'restrict,expiry-time="20261231"') to every key served in authorized_keys and shell script formats.
+// Only options understood by OpenSSH are accepted.
+// The -allowed-key-options flag configures which options clients may add using the 'options' query parameter.
+// By default, these are only options restricting keys; options such as 'command' have to be explicitly allowed.
+//
+//	-team name=user1,user2
+//
+// Defines a team whose members' keys are served under '/team/name'.
+// May be repeated to define several teams.
 //
 //	-index filename
 //
@@ -98,6 +355,10 @@
 // akhttpd can in addition to the standard routes serve a '_' route.
 // Use this flag to configure a directory to be served from this path
 //
+//	-metrics
+//
+// Serve metrics in the Prometheus text format on '/_/metrics'.
+//
 //	-allow-uploads, -upload-auth USER:PASSWORD
 //
 // akhttpd can optionally allow users to upload their own keys temporarily.
@@ -105,135 +366,647 @@
 // The upload-auth can also be provided with the UPLOAD_AUTH environment variable.
 // Providing this variable automatically implies -allow-uploads.
 //
+//	-upload-store path, -upload-max-ttl duration
+//
+// By default, uploaded keys are removed as soon as the upload page is closed.
+// With -upload-store, users can instead choose to keep their keys for a limited time, at most 7 days by default.
+// They receive a token to revoke the keys before they expire using 'POST /_/upload/revoke' with the 'token' form value.
+// These keys are kept in the given file, and survive restarts.
+// Keys uploaded using the api are also kept in this file, or only in memory without -upload-store.
+//
+//	-upload-max-count count, -upload-max-per-client count
+//
+// At most 1000 uploads are kept for a limited time at once, and at most 10 for each client (ip address, or /64 network for IPv6).
+// This includes keys uploaded using the api, even without -upload-store.
+// Further uploads are rejected until earlier ones expire or are revoked, the api then returns HTTP 429.
+//
+//	-rate-limit rate, -rate-limit-burst requests, -rate-limit-allow network1,network2
+//
+// Optionally limit the number of requests for keys every client may make, to avoid exhausting upstream API limits.
+// Each client may make up to -rate-limit-burst (by default 10) requests at once, after which further requests are allowed at the given rate per second.
+// Requests for the keys of several users, or of a team, count once for every user.
+// Requests beyond this return HTTP 429 with a Retry-After header.
+// Other routes, such as '/' or '/robots.txt', are not limited.
+// Clients in the given networks (ip addresses or CIDR ranges) are never limited.
+// The ip address of clients is determined as for the access log, see -trusted-proxies below.
+//
+//	-rate-limit-ipv4-prefix bits, -rate-limit-ipv6-prefix bits
+//
+// Clients within the same network share a limit.
+// By default, every ipv4 address and every ipv6 /64 network are limited separately.
+//
+//	-log-format text|json
+//
+// All logs are written in the given format, by default 'text'.
+//
+//	-access-log destination, -trusted-proxies proxy1,proxy2
+//
+// Optionally write an access log entry for every request to the given file, or '-' for standard error.
+// Each entry includes the path, status, latency and ip address of the client.
+// Requests for keys also include the requested user, the formatter, the source of the keys and the number of keys served.
+// When akhttpd runs behind a reverse proxy, its address (or a CIDR range) should be passed to -trusted-proxies.
+// The ip address of clients is then taken from the 'X-Forwarded-For' header.
+// Requests on unix sockets are assumed to come from a trusted proxy.
+//
+//	-audit-log destination
+//
+// Optionally write an audit log entry whenever keys are uploaded or released to the given file, or '-' for standard error.
+//
 //	LEGAL_BLOCK=user1,user2
 //
 // For legal reasons it might be necessary to block specific users from being served using this service.
 // To block a specific user, use the LEGAL_BLOCK variable.
 // It contains a comma-separated list of users to be blocked.
+// In the configuration file, use the 'blocked' option instead.
 package main
 
-// spellchecker:words akhttpd akpath
+// spellchecker:words akhttpd akpath gitea forgejo lrucache httpcache keygen
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/die-net/lrucache"
+	"github.com/gregjones/httpcache"
+	"github.com/pkg/errors"
 	"github.com/tkw1536/akhttpd"
 	"github.com/tkw1536/akhttpd/legal"
+	"github.com/tkw1536/akhttpd/pkg/diskcache"
 	"github.com/tkw1536/akhttpd/pkg/format"
+	"github.com/tkw1536/akhttpd/pkg/metrics"
 	"github.com/tkw1536/akhttpd/pkg/repo"
 )
 
 func main() {
+	if isAuthorizedKeysCommand() {
+		os.Exit(authorizedKeysCommand(os.Args[2:]))
+	}
+
+	config, err := loadConfig(configPath, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// setup logging
+	logHandler, err := newLogHandler(os.Stderr, config.Log.Format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(slog.New(logHandler))
+
+	accessLog, err := newLogger(config.Log.Access, config.Log.Format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auditLog, err := newLogger(config.Log.Audit, config.Log.Format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxies, err := akhttpd.ParseTrustedProxies(config.Log.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if configPath != "" {
+		log.Printf("loaded configuration from %s", configPath)
+	}
+
+	// the cache and uploaded keys are kept when reloading, other state is kept by newHandler
+	s := server{proxies: proxies}
+	if config.Cache.Dir != "" {
+		// use a subdirectory, so that evicting responses never removes entries of the authorized-keys-command
+		dir := filepath.Join(config.Cache.Dir, upstreamCacheDir)
+		log.Printf("caching upstream responses in %s", dir)
+		s.cache = &diskcache.Cache{Dir: dir, MaxSize: config.Cache.DirSize, MaxAge: config.Cache.Age}
+	} else {
+		s.cache = lrucache.New(config.Cache.Size, int64(config.Cache.Age.Seconds()))
+	}
+	if config.Uploads.Enabled {
+		s.uploadable = new(repo.UploadableKeys)
+	}
+
+	var current atomic.Pointer[http.ServeMux]
+	{
+		mux, err := s.newHandler(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		current.Store(mux)
+	}
+
+	if s.uploadable != nil {
+		log.Printf("enabling user uploads")
+		s.uploadable.Prefix = "uploaded-"
+		s.uploadable.WriteSuffix = s.writeSuffix
+		s.uploadable.Audit = auditLog
+		s.uploadable.ClientIP = proxies.ClientIP
+		s.uploadable.MaxTTL = config.Uploads.MaxTTL
+		s.uploadable.MaxPersistent = config.Uploads.MaxCount
+		s.uploadable.MaxPersistentPerClient = config.Uploads.MaxPerClient
+		if config.Uploads.Auth != "" {
+			log.Printf("enabling protected user uploads")
+			s.uploadable.AuthUser, s.uploadable.AuthPassword, _ = strings.Cut(config.Uploads.Auth, ":")
+		}
+		if config.Uploads.Store != "" {
+			log.Printf("keeping persistent user uploads in %s", config.Uploads.Store)
+			s.uploadable.Store = config.Uploads.Store
+			if err := s.uploadable.Load(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// reload the configuration on SIGHUP.
+	// requests that are in progress finish using the previous configuration.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("reloading configuration")
+			next, err := loadConfig(configPath, os.Args[1:])
+			if err != nil {
+				log.Printf("failed to reload configuration: %s", err)
+				continue
+			}
+			warnStartupOnly(config, next)
+
+			mux, err := s.newHandler(next)
+			if err != nil {
+				log.Printf("failed to reload configuration: %s", err)
+				continue
+			}
+			current.Store(mux)
+			log.Printf("reloaded configuration")
+		}
+	}()
+
+	// bind and listen to the server
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current.Load().ServeHTTP(w, r)
+	})
+	if accessLog != nil {
+		handler = akhttpd.AccessLog{Handler: handler, Logger: accessLog, Proxies: proxies}
+	}
+
+	srv := &http.Server{
+		Addr:              config.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		ReadTimeout:       config.Server.ReadTimeout,
+		WriteTimeout:      config.Server.WriteTimeout,
+		IdleTimeout:       config.Server.IdleTimeout,
+	}
+
+	// shutdown gracefully on SIGTERM or SIGINT
+	done := make(chan struct{})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		defer close(done)
+
+		<-term
+		log.Printf("shutting down")
+		s.draining.Store(true)
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout)
+		defer cancel()
+
+		s.shutdown(ctx, srv)
+	}()
+
+	listener, err := listen(config.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if config.Server.TLSCert != "" || config.Server.TLSKey != "" {
+		if config.Server.TLSCert == "" || config.Server.TLSKey == "" {
+			log.Fatal("both a tls certificate and key are required")
+		}
+		certs, certErr := newCertificateReloader(config.Server.TLSCert, config.Server.TLSKey)
+		if certErr != nil {
+			log.Fatal(certErr)
+		}
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+
+		log.Printf("Listening on %s (tls)\n", listenerName(listener))
+		err = srv.ServeTLS(listener, "", "")
+	} else {
+		log.Printf("Listening on %s\n", listenerName(listener))
+		err = srv.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+// server holds state that is shared between configurations
+type server struct {
+	cache      httpcache.Cache      // cache for upstream responses
+	uploadable *repo.UploadableKeys // uploaded keys, nil if uploads are disabled
+	proxies    akhttpd.TrustedProxies
+
+	repositories    *repositories      // current key repositories
+	rateLimit       *akhttpd.RateLimit // current rate limit, nil if disabled
+	rateLimitConfig RateLimitConfig    // configuration of rateLimit
+
+	handler atomic.Pointer[akhttpd.Handler] // the current handler
+
+	draining atomic.Bool // is the server shutting down
+}
+
+// shutdown gracefully shuts down srv and closes all upload sessions.
+// When ctx is done before, closes all remaining connections.
+func (s *server) shutdown(ctx context.Context, srv *http.Server) {
+	// upload sessions are hijacked connections, not tracked by srv
+	uploads := make(chan struct{})
+	go func() {
+		defer close(uploads)
+		if s.uploadable != nil {
+			s.uploadable.Shutdown()
+		}
+	}()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("failed to shut down gracefully: %s", err)
+		srv.Close()
+	}
+
+	select {
+	case <-uploads:
+	case <-ctx.Done():
+		log.Printf("failed to close upload sessions gracefully: %s", ctx.Err())
+	}
+}
+
+// writeSuffix writes the html suffix of the current handler
+func (s *server) writeSuffix(w io.Writer) error {
+	return s.handler.Load().WriteSuffix(w)
+}
+
+// newRateLimit returns the rate limit for the given configuration, or nil if it is disabled.
+// When the configuration is unchanged, the previous rate limit is returned, so that clients can not reset it by causing a reload.
+// The rate limit only becomes the current one once stored by newHandler.
+func (s *server) newRateLimit(config RateLimitConfig) (*akhttpd.RateLimit, error) {
+	if config.Rate <= 0 {
+		return nil, nil
+	}
+	if s.rateLimit != nil && reflect.DeepEqual(s.rateLimitConfig, config) {
+		return s.rateLimit, nil
+	}
+
+	if config.Burst < 1 {
+		return nil, errors.New("burst must be positive")
+	}
+	if config.IPv4Prefix < 0 || config.IPv4Prefix > 32 || config.IPv6Prefix < 0 || config.IPv6Prefix > 128 {
+		return nil, errors.New("invalid prefix length")
+	}
+	allowed, err := akhttpd.ParseNetworks(config.Allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("limiting requests for keys to %g per second with a burst of %d per client", config.Rate, config.Burst)
+	return &akhttpd.RateLimit{
+		Rate:       config.Rate,
+		Burst:      config.Burst,
+		IPv4Prefix: config.IPv4Prefix,
+		IPv6Prefix: config.IPv6Prefix,
+		Allowed:    allowed,
+		Proxies:    s.proxies,
+	}, nil
+}
+
+// repositories are the key repositories of a handler
+type repositories struct {
+	config repositoriesConfig
+
+	Local     repo.Combo       // local repositories, checked first
+	Upstreams repo.Combo       // remote repositories, checked afterwards
+	GitHub    *repo.GitHubKeys // the GitHub repository within Upstreams
+	Keys      repo.Combo       // Local, followed by Upstreams wrapped in repo.Stale
+}
+
+// Check checks all local and remote repositories.
+func (r *repositories) Check(ctx context.Context) error {
+	return slices.Concat(r.Local, r.Upstreams).Check(ctx)
+}
+
+// repositoriesConfig is the part of the configuration that repositories are created from
+type repositoriesConfig struct {
+	AKPath string
+
+	GitHub UpstreamConfig
+	GitLab UpstreamConfig
+	Gitea  UpstreamConfig
+
+	APITimeout      time.Duration
+	StaleMaxAge     time.Duration
+	StaleMaxEntries int
+}
+
+// newRepositories returns the key repositories for the given configuration.
+// When the configuration is unchanged, the previous repositories are returned, so that remembered stale keys and the GitHub rate limit state survive a reload.
+// The repositories only become the current ones once stored by newHandler.
+func (s *server) newRepositories(config Config) (*repositories, error) {
+	rc := repositoriesConfig{
+		AKPath: config.AKPath,
+
+		GitHub: config.GitHub,
+		GitLab: config.GitLab,
+		Gitea:  config.Gitea,
+
+		APITimeout:      config.APITimeout,
+		StaleMaxAge:     config.StaleMaxAge,
+		StaleMaxEntries: config.StaleMaxEntries,
+	}
+	if s.repositories != nil && s.repositories.config == rc {
+		return s.repositories, nil
+	}
+
+	// local repositories are never served stale, so that removed keys are not served again
+	local := make(repo.Combo, 0, 2)
 	repos := make(repo.Combo, 0, 3)
 
-	// create a repository for uploadable uploadable
-	var uploadable repo.UploadableKeys
-	if allowUploads {
-		repos = append(repos, &uploadable)
+	// use the uploaded keys
+	if s.uploadable != nil {
+		local = append(local, s.uploadable)
 	}
 
 	// create the files directory first
-	if akFilesPath != "" {
-		log.Printf("will check for public keys in %s", akFilesPath)
-		disk := repo.Disk{FS: os.DirFS(akFilesPath)}
-		repos = append(repos, disk)
+	if config.AKPath != "" {
+		log.Printf("will check for public keys in %s", config.AKPath)
+		disk := repo.Disk{FS: os.DirFS(config.AKPath)}
+		local = append(local, disk)
+	}
+
+	// create a gitlab key repo (if configured)
+	if config.GitLab.URL != "" {
+		log.Printf("will check for public keys on GitLab at %s", config.GitLab.URL)
+		gl, err := repo.NewGitLabKeys(repo.GitLabKeysOptions{
+			BaseURL: config.GitLab.URL,
+			Token:   config.GitLab.Token,
+			Timeout: config.APITimeout,
+			Cache:   s.cache,
+		})
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, gl)
+	}
+
+	// create a gitea key repo (if configured)
+	if config.Gitea.URL != "" {
+		log.Printf("will check for public keys on Gitea at %s", config.Gitea.URL)
+		gt, err := repo.NewGiteaKeys(repo.GiteaKeysOptions{
+			BaseURL: config.Gitea.URL,
+			Token:   config.Gitea.Token,
+			Timeout: config.APITimeout,
+			Cache:   s.cache,
+		})
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, gt)
 	}
 
 	// create a github key repo
-	gr, err := repo.NewGitHubKeys(repo.GitHubKeysOptions{
-		Token:        token,
-		Timeout:      apiTimeout,
-		MaxCacheSize: cacheBytes,
-		MaxCacheAge:  cacheTimeout,
-	})
+	githubOptions := repo.GitHubKeysOptions{
+		Token:   config.GitHub.Token,
+		Timeout: config.APITimeout,
+		Cache:   s.cache,
+	}
+	if config.GitHub.URL != "" {
+		log.Printf("will check for public keys on GitHub Enterprise Server at %s", config.GitHub.URL)
+		base, err := url.Parse(config.GitHub.URL)
+		if err != nil {
+			return nil, err
+		}
+		githubOptions.BaseURL = base.JoinPath("api", "v3").String()
+		githubOptions.UploadURL = base.JoinPath("api", "uploads").String()
+	}
+	gr, err := repo.NewGitHubKeys(githubOptions)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	repos = append(repos, gr)
 
+	// serve stale keys when upstreams fail
+	if config.StaleMaxAge > 0 {
+		log.Printf("serving stale keys for up to %s when upstreams fail", config.StaleMaxAge)
+	}
+	stale := &repo.Stale{
+		Repository: &repo.Coalesced{Repository: repos},
+		MaxAge:     config.StaleMaxAge,
+		MaxEntries: config.StaleMaxEntries,
+	}
+
+	return &repositories{
+		config: rc,
+
+		Local:     local,
+		Upstreams: repos,
+		GitHub:    gr,
+		Keys:      append(slices.Clone(local), stale),
+	}, nil
+}
+
+// newHandler creates a new handler for the given configuration.
+// The state of s is only updated once the entire configuration has been validated.
+func (s *server) newHandler(config Config) (*http.ServeMux, error) {
+	// validate the key policy and options
+	policy, err := parseKeyPolicy(config.KeyPolicy)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key policy")
+	}
+	if _, err := format.ParseOptions(config.Formatters.KeyOptions); err != nil {
+		return nil, err
+	}
+	allowedOptions, err := format.ParseOptionNames(config.Formatters.AllowedKeyOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid allowed key options")
+	}
+	allowed_signers := format.AllowedSigners{Principal: config.Formatters.SignersPrincipal, SigningKeys: config.Formatters.SignersSigningKeys}
+	if err := allowed_signers.CheckPrincipal(); err != nil {
+		return nil, err
+	}
+
+	rateLimit, err := s.newRateLimit(config.RateLimit)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid rate limit")
+	}
+
+	repos, err := s.newRepositories(config)
+	if err != nil {
+		return nil, err
+	}
+	var r repo.KeyRepository = repos.Keys
+
 	// blacklist provided users
-	r := &repo.Blocklisted{
-		Repository: repos,
-		Blocked:    blocked,
+	if len(config.Blocked) > 0 {
+		log.Printf("blocking %d user(s) for legal reasons", len(config.Blocked))
+	}
+	r = &repo.Blocklisted{
+		Repository: r,
+		Blocked:    config.Blocked,
+	}
+
+	// filter keys according to the policy
+	if !policy.IsZero() {
+		log.Printf("filtering keys using policy %q", config.KeyPolicy)
+	}
+	r = &repo.Filtered{
+		Repository: r,
+		Policy:     policy,
 	}
 
 	// make a handler
-	h := &akhttpd.Handler{KeyRepository: r}
+	h := &akhttpd.Handler{KeyRepository: r, Timeout: config.RequestTimeout, Teams: config.Teams, RateLimit: rateLimit}
+	for name, members := range config.Teams {
+		log.Printf("serving team %q with members %s", name, strings.Join(members, ", "))
+	}
+
+	options := format.KeyOptions{Default: config.Formatters.KeyOptions}
+	if len(allowedOptions) > 0 {
+		options.Allowed = allowedOptions
+	}
 
-	sh := format.ShellScript{}
-	html := format.HTML{Suffix: h.WriteSuffix}
-	authorized_keys := format.AuthorizedKeys{}
+	sh := format.ShellScript{Options: options}
+	html := format.HTML{Suffix: h.WriteSuffix, Profiles: profiles(config)}
+	authorized_keys := format.AuthorizedKeys{Options: options}
+	json := format.JSON{}
 	magic := format.Magic{AuthorizedKeys: authorized_keys, HTML: html}
 
 	h.RegisterFormatter("", magic)
 	h.RegisterFormatter("authorized_keys", authorized_keys)
 	h.RegisterFormatter("sh", sh)
 	h.RegisterFormatter("html", html)
+	h.RegisterFormatter("json", json)
+	h.RegisterFormatter("allowed_signers", allowed_signers)
 
-	h.IndexHTMLPath = indexHTMLPath
-	if indexHTMLPath != "" {
-		log.Printf("loaded '/' from %s", indexHTMLPath)
+	h.IndexHTMLPath = config.Index
+	if config.Index != "" {
+		log.Printf("loaded '/' from %s", config.Index)
 	}
 
-	h.SuffixHTMLPath = suffixHTMLPath
-	if suffixHTMLPath != "" {
-		log.Printf("loaded html suffix from %s", suffixHTMLPath)
+	h.SuffixHTMLPath = config.Suffix
+	if config.Suffix != "" {
+		log.Printf("loaded html suffix from %s", config.Suffix)
 	}
 
-	if underscorePath != "" {
-		log.Printf("serving '/_/' from %s", underscorePath)
-		http.Handle("/_/", h.ServeUnderscore(underscorePath))
+	mux := http.NewServeMux()
+
+	if config.Serve != "" {
+		log.Printf("serving '/_/' from %s", config.Serve)
+		mux.Handle("/_/", h.ServeUnderscore(config.Serve))
 	}
-	http.Handle("/", h)
+	mux.Handle("/", h)
 
-	if allowUploads {
-		log.Printf("enabling user uploads")
-		uploadable.Prefix = "uploaded-"
-		uploadable.WriteSuffix = h.WriteSuffix
-		if uploadAuth != "" {
-			log.Printf("enabling protected user uploads")
-			uploadable.AuthUser, uploadable.AuthPassword, _ = strings.Cut(uploadAuth, ":")
-		}
+	mux.Handle("/_/status", akhttpd.Status{GitHub: repos.GitHub})
 
-		http.Handle("/_/upload/", &uploadable)
+	health := akhttpd.Health{Checker: repos, Draining: s.draining.Load}
+	mux.HandleFunc("/_/healthz", health.ServeLive)
+	mux.HandleFunc("/_/readyz", health.ServeReady)
+
+	if config.Metrics {
+		log.Printf("serving metrics on '/_/metrics'")
+		mux.Handle("/_/metrics", metrics.Handler())
 	}
 
-	// bind and listen to the server
-	log.Printf("Listening on %s\n", bindAddress)
-	if err := http.ListenAndServe(bindAddress, nil); err != http.ErrServerClosed {
-		log.Fatal(err)
+	if s.uploadable != nil {
+		mux.Handle("/_/upload/", s.uploadable)
 	}
+
+	s.repositories = repos
+	s.rateLimit, s.rateLimitConfig = rateLimit, config.RateLimit
+	s.handler.Store(h)
+	return mux, nil
 }
 
-var bindAddress = "localhost:8080"
+// warnStartupOnly warns about options that differ between old and new, but can not be changed without a restart.
+func warnStartupOnly(old, new Config) {
+	changed := func(name string, old, new any) {
+		if !reflect.DeepEqual(old, new) {
+			log.Printf("option %q changed, but only takes effect after a restart", name)
+		}
+	}
+	changed("listen", old.Listen, new.Listen)
+	changed("server", old.Server, new.Server)
+	changed("cache", old.Cache, new.Cache)
+	changed("uploads", old.Uploads, new.Uploads)
+	changed("log", old.Log, new.Log)
+}
 
-// flags
-var token = os.Getenv("GITHUB_TOKEN")
-var blocked = (func(blocked string) []string {
-	if blocked == "" {
-		return nil
+// parseKeyPolicy parses a key policy given in query string syntax
+func parseKeyPolicy(value string) (repo.Policy, error) {
+	query, err := url.ParseQuery(value)
+	if err != nil {
+		return repo.Policy{}, err
 	}
-	return strings.Split(blocked, ",")
-})(os.Getenv("LEGAL_BLOCK"))
-var cacheBytes int64 = 25 * 1000
-var cacheTimeout = 1 * time.Hour
-var apiTimeout = 1 * time.Second
+	return repo.ParsePolicy(query)
+}
 
-var indexHTMLPath = ""
-var suffixHTMLPath = ""
-var underscorePath = ""
-var akFilesPath = ""
+// profiles returns the profiles to link to for each of the sources
+func profiles(config Config) map[string]format.Profile {
+	profiles := map[string]format.Profile{
+		"github": {Name: "GitHub", URL: profileURL(config.GitHub.URL, "https://github.com/")},
+	}
+	if config.GitLab.URL != "" {
+		profiles["gitlab"] = format.Profile{Name: "GitLab", URL: profileURL(config.GitLab.URL, "")}
+	}
+	if config.Gitea.URL != "" {
+		profiles["gitea"] = format.Profile{Name: "Gitea", URL: profileURL(config.Gitea.URL, "")}
+	}
+	return profiles
+}
+
+// profileURL returns the url to link user profiles to, ensuring it ends with a slash
+func profileURL(url, fallback string) string {
+	if url == "" {
+		return fallback
+	}
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return url
+}
+
+// upstreamCacheDir is the subdirectory of the cache directory to cache upstream responses in
+const upstreamCacheDir = "upstream"
 
-var uploadAuth = os.Getenv("UPLOAD_AUTH")
-var allowUploads = len(uploadAuth) > 0
+// configPath is the path to the configuration file, if any
+var configPath = ""
+
+// isAuthorizedKeysCommand checks if the authorized-keys-command subcommand was invoked
+func isAuthorizedKeysCommand() bool {
+	return len(os.Args) > 1 && os.Args[1] == authorizedKeysCommandName
+}
 
 func init() {
+	// the subcommand parses its own flags
+	if isAuthorizedKeysCommand() {
+		return
+	}
+
 	var legalFlag bool
 	flag.BoolVar(&legalFlag, "legal", legalFlag, "Print legal notices and exit")
 	defer func() {
@@ -245,24 +1018,11 @@ func init() {
 		}
 	}()
 
-	flag.StringVar(&token, "token", token, "token for github authentication (can also be set by 'GITHUB_TOKEN' variable). ")
-	flag.Int64Var(&cacheBytes, "cache-size", cacheBytes, "maximum in-memory cache size in bytes")
-	flag.DurationVar(&cacheTimeout, "cache-age", cacheTimeout, "maximum time after which cache entries should expire")
-	flag.DurationVar(&apiTimeout, "api-timeout", apiTimeout, "timeout for github API connection")
-	flag.StringVar(&indexHTMLPath, "index", indexHTMLPath, "optional path to '/' serve. Assumed to be of mime-type html. ")
-	flag.StringVar(&suffixHTMLPath, "suffix", suffixHTMLPath, "optional path to append to all html responses. Assumed to be of mime-type html. ")
-	flag.StringVar(&underscorePath, "serve", underscorePath, "optional path to '_' static directory to serve. ")
-	flag.StringVar(&akFilesPath, "akpath", akFilesPath, "optional path to check for additional authorized keys files")
-	flag.BoolVar(&allowUploads, "allow-uploads", allowUploads, "serve the '/_/upload/' path to allow users to temporarily upload their own keys")
-	flag.StringVar(&uploadAuth, "upload-auth", uploadAuth, "Protect '/_/upload/' with a 'username:password' combination")
+	// the flags are only parsed here to validate them and provide help.
+	// the configuration is loaded by main, so that flags take precedence over the configuration file.
+	config := defaultConfig()
+	config.bindFlags(flag.CommandLine)
+	flag.StringVar(&configPath, "config", configPath, "optional path to a yaml configuration file, reloaded on SIGHUP")
 
 	flag.Parse()
-
-	// read command line arguments
-	if flag.NArg() != 1 {
-		return
-	}
-
-	// read the bind address
-	bindAddress = flag.Arg(0)
 }
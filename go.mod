@@ -11,6 +11,7 @@ require (
 	github.com/tkw1536/pkglib v0.0.0-20250414190927-f9a88308b643
 	golang.org/x/crypto v0.37.0
 	golang.org/x/oauth2 v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
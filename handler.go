@@ -2,15 +2,20 @@ package akhttpd
 
 import (
 	"context"
+	"crypto/sha256"
 	_ "embed" // include default robots.txt and index.html
+	"encoding/hex"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tkw1536/akhttpd/pkg/format"
+	"github.com/tkw1536/akhttpd/pkg/metrics"
 	"github.com/tkw1536/akhttpd/pkg/repo"
 )
 
@@ -25,8 +30,20 @@ type Handler struct {
 	SuffixHTMLPath string // if non-empty, path to append to every html response
 	IndexHTMLPath  string // if non-empty, path to serve index.html from
 	RobotsTXTPath  string // if non-empty, path to serve robots.txt from
+
+	Timeout time.Duration // if non-zero, maximum time to spend resolving keys for a single request
+
+	// RateLimit, if non-nil, limits the rate at which each client may request keys.
+	RateLimit *RateLimit
+
+	// Teams are named groups of users whose keys can be requested together under '/team/${name}'.
+	// When empty, '/team/' is treated like any other username.
+	Teams map[string][]string
 }
 
+// maxUsersPerRequest is the maximum number of users whose keys can be requested at once using '+'
+const maxUsersPerRequest = 16
+
 // RegisterFormatter registers formatter as the formatter for the provided extension.
 // When extension is empty, registers it for the path without an extension.
 func (h *Handler) RegisterFormatter(extension string, formatter format.Formatter) {
@@ -54,7 +71,8 @@ func (h Handler) WriteSuffix(w io.Writer) error {
 	return err
 }
 
-var handlerPath = regexp.MustCompile(`^/[a-zA-Z\d-@]+((\.[a-zA-Z]+)|/[a-zA-Z_]+)?/?$`)
+var handlerPath = regexp.MustCompile(`^/[a-zA-Z\d-@+]+((\.[a-zA-Z_]+)|/[a-zA-Z_]+)?/?$`)
+var teamPath = regexp.MustCompile(`^/team/[a-zA-Z\d_-]+((\.[a-zA-Z_]+)|/[a-zA-Z_]+)?/?$`)
 
 //go:embed resources/index.min.html
 var defaultIndexHTML []byte
@@ -63,7 +81,8 @@ var defaultIndexHTML []byte
 var defaultRobotsTXT []byte
 
 // ServerHTTP serves the main akhttpd server.
-// It only answers to GET requests, all other requests are answered with Method Not Allowed.
+// It only answers to GET and HEAD requests, all other requests are answered with Method Not Allowed.
+// HEAD requests are answered like GET requests, but without a body.
 // Whenever something goes wrong, responds with "Internal Server Error" and logs the error.
 //
 // This method only responds successfully to a few URLS.
@@ -81,6 +100,35 @@ var defaultRobotsTXT []byte
 // Fetches SSH Keys for the provided user and formats them with formatter.
 // When formatter is omitted, uses the default formatter.
 // If the formatter or user do not exist, returns HTTP 404.
+// If fetching the keys is cancelled or exceeds Timeout, returns HTTP 504.
+// If an upstream rate limit is exhausted (and no cached keys exist), returns HTTP 503 with a Retry-After header.
+// If the client exceeds RateLimit, returns HTTP 429 with a Retry-After header.
+// Every requested user counts as a separate request towards RateLimit.
+// When the KeyRepository serves stale keys (see repo.Stale), the response includes 'Warning' and 'Age' headers.
+//
+// The query parameters 'type', 'exclude' and 'min-rsa-bits' can be used to filter the returned keys.
+// See repo.ParsePolicy.
+// This requires the KeyRepository to (directly or indirectly) be a repo.Filtered.
+// If these parameters are invalid, returns HTTP 400.
+// Some formatters support additional query parameters, such as 'options', see format.KeyOptions.
+//
+// Responses include an ETag header, computed from the returned keys (but not the generation time).
+// When it matches the If-None-Match header of the request, returns HTTP 304 without a body.
+//
+//	GET /${username1}+${username2}+...
+//	GET /${username1}+${username2}+....${formatter}, GET /${username1}+${username2}+.../${formatter}
+//
+// Like the above, but fetches and merges the keys of several users.
+// Identical keys are only included once, and each key is annotated with the user it belongs to.
+// If any of the users do not exist, returns HTTP 404.
+// When more than 16 users are requested, returns HTTP 400.
+//
+//	GET /team/${name}
+//	GET /team/${name}.${formatter}, GET /team/${name}/${formatter}
+//
+// Like the above, but fetches and merges the keys of all members of the provided team.
+// If the team does not exist, returns HTTP 404.
+// This route only exists when Teams is not empty.
 //
 //	GET /robots.txt
 //
@@ -88,10 +136,10 @@ var defaultRobotsTXT []byte
 // When RobotsTXTPath is empty, it sends back a default robots.txt file.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
-	// ensure that only a GET is used, we don't support anything else
-	// this includes just requesting HEAD.
-	if r.Method != http.MethodGet {
-		w.Header().Add("Allow", "GET")
+	// ensure that only a GET or HEAD is used, we don't support anything else.
+	// HEAD requests are handled like GET; net/http discards the body.
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Add("Allow", "GET, HEAD")
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -99,7 +147,6 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 
 	switch {
-	case r.Method != http.MethodGet:
 	case path == "/", path == "":
 		err := handlePathOrFallback(w, h.IndexHTMLPath, defaultIndexHTML, "text/html")
 		if err != nil {
@@ -111,36 +158,134 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case path == "/favicon.ico": // performance optimization as web browsers frequently request this
 		http.NotFound(w, r)
 
-	case handlerPath.MatchString(path): // the main route, where the bulk of handling takes place
-		path = strings.Trim(path, "/")
-		var ext string
+	case len(h.Teams) > 0 && teamPath.MatchString(path): // keys for a team
+		name, ext := splitExtension(strings.TrimPrefix(path, "/team/"))
 
-		// handle both '.' and '/' as an index
-		idx := strings.IndexRune(path, '.')
-		if idx == -1 {
-			idx = strings.IndexRune(path, '/')
+		members, ok := h.Teams[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
 		}
+		h.serveAuthorizedKey(w, r, name, members, true, ext)
+
+	case handlerPath.MatchString(path): // the main route, where the bulk of handling takes place
+		name, ext := splitExtension(path)
 
-		if idx != -1 {
-			ext = path[idx+1:]
-			path = path[:idx]
+		users := strings.Split(name, "+")
+		if len(users) > maxUsersPerRequest {
+			http.Error(w, "Too many users requested", http.StatusBadRequest)
+			return
+		}
+		for _, user := range users {
+			if user == "" {
+				http.NotFound(w, r)
+				return
+			}
 		}
-		h.serveAuthorizedKey(w, r, path, ext)
+		h.serveAuthorizedKey(w, r, name, users, false, ext)
 
 	default: // everything else isn't found
 		http.NotFound(w, r)
 	}
 }
 
-// serveAuthorizedKey serves an authorized_keys file for a given user
-func (h Handler) serveAuthorizedKey(w http.ResponseWriter, r *http.Request, username, formatName string) {
+// splitExtension splits path into a name and an extension.
+// Both '.' and '/' are treated as separators.
+func splitExtension(path string) (name, ext string) {
+	path = strings.Trim(path, "/")
+
+	// handle both '.' and '/' as an index
+	idx := strings.IndexRune(path, '.')
+	if idx == -1 {
+		idx = strings.IndexRune(path, '/')
+	}
+
+	if idx != -1 {
+		return path[:idx], path[idx+1:]
+	}
+	return path, ""
+}
+
+// serveAuthorizedKey serves an authorized_keys file for the given users under the given name.
+// When more than one user is provided, or the users are the members of a team, their keys are merged.
+func (h Handler) serveAuthorizedKey(w http.ResponseWriter, r *http.Request, username string, users []string, team bool, formatName string) {
 	formatter, hasFormatter := h.Formatters[strings.ToLower(formatName)]
+
+	// record the request in the metrics and access log, once it is done
+	var source string
+	var keys []repo.Key
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	defer func() {
+		formatLabel := strings.ToLower(formatName)
+		switch {
+		case !hasFormatter:
+			formatLabel = "unknown"
+		case formatLabel == "":
+			formatLabel = "default"
+		}
+		requestsTotal.Inc(formatLabel, strconv.Itoa(sw.Status()), source)
+
+		if record := accessRecordFromContext(r.Context()); record != nil {
+			record.User = username
+			record.Formatter = formatLabel
+			record.Source = source
+			record.Keys = len(keys)
+		}
+	}()
+
+	// every user may cause an upstream request
+	if ok, retry := h.RateLimit.Allow(r, len(users)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter(retry)))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
 	if !hasFormatter {
 		http.NotFound(w, r)
 		return
 	}
 
-	source, keys, err := h.KeyRepository.GetKeys(context.Background(), username)
+	// parse the key policy requested by the client
+	policy, err := repo.ParsePolicy(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// validate any other input of the formatter before fetching keys
+	if vf, ok := formatter.(format.ValidatingFormatter); ok {
+		if err := vf.Validate(r); err != nil {
+			if bre, isBadRequest := err.(format.BadRequestError); isBadRequest {
+				http.Error(w, "Bad Request: "+bre.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("%s: Internal Server Error: %s", r.URL.Path, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// record details of resolving keys in the request.
+	// formatters may use these.
+	ctx, report := repo.WithReport(r.Context())
+	r = r.WithContext(ctx)
+
+	// resolve keys within the context of the request
+	// and (optionally) the server-side deadline.
+	ctx = repo.WithPolicy(ctx, policy)
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	// request keys for the right usage
+	if uf, ok := formatter.(format.UsageFormatter); ok {
+		ctx = repo.WithUsage(ctx, uf.Usage())
+	}
+
+	source, keys, err = h.getKeys(ctx, users, team)
 	if err != nil {
 		if _, isNotFound := err.(repo.UserNotFoundError); isNotFound {
 			http.NotFound(w, r)
@@ -152,15 +297,138 @@ func (h Handler) serveAuthorizedKey(w http.ResponseWriter, r *http.Request, user
 			return
 		}
 
+		if rle, isRateLimited := err.(repo.RateLimitedError); isRateLimited {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter(rle.Reset)))
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		if _, isTimeout := err.(repo.UpstreamTimeoutError); isTimeout {
+			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+			return
+		}
+
 		log.Printf("%s: Internal Server Error: %s", r.URL.Path, err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
+	// warn the client when (some of) the keys are stale
+	if fetched, stale := report.Stale(); stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(fetched).Seconds())))
+	}
+
+	// the response depends on the request headers of the variant
+	if vf, ok := formatter.(format.VariantFormatter); ok {
+		for _, header := range vf.Vary() {
+			w.Header().Add("Vary", header)
+		}
+	}
+
+	// send back an etag, and check if the client already has the response
+	etag := h.etag(r, formatName, username, source, keys, formatter)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	n, err := formatter.WriteTo(username, source, keys, r, w)
+	if n == 0 && err != nil {
+		// error responses must not be cached
+		w.Header().Del("ETag")
+	}
+	if bre, isBadRequest := err.(format.BadRequestError); n == 0 && isBadRequest {
+		http.Error(w, "Bad Request: "+bre.Error(), http.StatusBadRequest)
+		return
+	}
 	if n == 0 && err != nil {
 		log.Printf("%s: Internal Server Error: %s", r.URL.Path, err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 }
+
+var requestsTotal = metrics.NewCounterVec(
+	"akhttpd_requests_total",
+	"Number of requests for keys by formatter, status code and source of the keys.",
+	"formatter", "status", "source",
+)
+
+// retryAfter returns the number of seconds until reset, but at least one.
+func retryAfter(reset time.Time) int {
+	seconds := int(time.Until(reset).Seconds() + 1)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// getKeys gets the keys of the provided users.
+// When more than one user is provided, or team is set, their keys are merged and the source is "team".
+func (h Handler) getKeys(ctx context.Context, users []string, team bool) (source string, keys []repo.Key, err error) {
+	if len(users) == 1 && !team {
+		return h.KeyRepository.GetKeys(ctx, users[0])
+	}
+
+	keys, err = repo.MergeKeys(ctx, h.KeyRepository, users...)
+	if err != nil {
+		return "", nil, err
+	}
+	return "team", keys, nil
+}
+
+// etag computes an etag for a response consisting of the provided keys.
+// It does not depend on the time the response was generated.
+func (h Handler) etag(r *http.Request, formatName, username, source string, keys []repo.Key, formatter format.Formatter) string {
+	hash := sha256.New()
+
+	// write writes a string into the hash, followed by a NUL byte as a separator
+	write := func(value string) {
+		io.WriteString(hash, value)
+		hash.Write([]byte{0})
+	}
+
+	write(strings.ToLower(formatName))
+	if vf, ok := formatter.(format.VariantFormatter); ok {
+		write(vf.Variant(r))
+	}
+	write(r.URL.RawQuery)
+	write(username)
+	write(source)
+
+	for _, key := range keys {
+		write(string(key.MarshalAuthorizedKey()))
+		write(key.Source)
+		write(key.User)
+	}
+
+	report := repo.ReportFromContext(r.Context())
+
+	// stale keys may be marked as such in the response
+	if fetched, stale := report.Stale(); stale {
+		write(fetched.String())
+	}
+
+	// keys that were filtered may be shown in the response
+	for _, fk := range report.Filtered() {
+		write(string(fk.Key.MarshalAuthorizedKey()))
+		write(fk.User)
+		write(fk.Reason)
+	}
+
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches checks if the If-None-Match header matches etag.
+// Uses the weak comparison function, as mandated by RFC 9110.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package akhttpd
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tkw1536/akhttpd/pkg/repo"
+)
+
+// spellchecker:words akhttpd healthz readyz
+
+// Health serves liveness and readiness probes, e.g. for use with Kubernetes.
+type Health struct {
+	// Checker is used to check readiness.
+	// When nil, readiness is not checked.
+	Checker repo.Checker
+
+	// Timeout is the maximum time to spend checking readiness.
+	// When zero, uses a default of 5 seconds.
+	Timeout time.Duration
+
+	// Draining is called to check if the server is shutting down.
+	// When it returns true, the server is no longer ready.
+	Draining func() bool
+}
+
+// ServeLive serves the liveness probe.
+// It always responds with HTTP 200.
+func (h Health) ServeLive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// ServeReady serves the readiness probe.
+// It responds with HTTP 200 if the Checker succeeds, and HTTP 503 otherwise, or when the server is draining.
+func (h Health) ServeReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if h.Draining != nil && h.Draining() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if h.Checker != nil {
+		timeout := h.Timeout
+		if timeout == 0 {
+			timeout = 5 * time.Second
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		if err := h.Checker.Check(ctx); err != nil {
+			log.Printf("%s: not ready: %s", r.URL.Path, err)
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	h.ServeLive(w, r)
+}
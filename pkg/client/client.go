@@ -0,0 +1,139 @@
+// Package client provides Client
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tkw1536/akhttpd/pkg/diskcache"
+)
+
+// spellchecker:words akhttpd
+
+// Client fetches authorized_keys files from an akhttpd server.
+//
+// Every successful response is stored in an on-disk cache.
+// When the server can not be reached, or responds with an error, the cached response is used instead.
+type Client struct {
+	// Server is the base url of the akhttpd server, e.g. "https://akhttpd.example.com/".
+	Server string
+
+	// CacheDir is the directory to cache responses in, see diskcache.Cache.
+	// It may be shared with the cache of an akhttpd server.
+	// When empty, responses are not cached.
+	CacheDir string
+
+	// Client is the http.Client used to make requests.
+	// When nil, uses http.DefaultClient.
+	Client *http.Client
+}
+
+// ErrUserNotFound is returned by Fetch when the server does not serve keys for a user.
+var ErrUserNotFound = errors.New("user not found")
+
+// Fetch fetches the authorized_keys file for the provided user.
+// It returns the file, a boolean indicating if the file was served from cache, and an error.
+//
+// When the server indicates that the user does not exist (or is blocked), any cached file is removed and ErrUserNotFound is returned.
+func (c Client) Fetch(ctx context.Context, username string) (keys []byte, cached bool, err error) {
+	target, err := c.url(username)
+	if err != nil {
+		return nil, false, err
+	}
+
+	keys, err = c.fetch(ctx, target)
+	switch {
+	case err == nil:
+		c.store(target, keys)
+		return keys, false, nil
+	case err == ErrUserNotFound:
+		c.remove(target)
+		return nil, false, err
+	}
+
+	// fallback to the cache
+	keys, cacheErr := c.load(target)
+	if cacheErr != nil {
+		return nil, false, err
+	}
+	return keys, true, nil
+}
+
+// url returns the url of the authorized_keys file of username
+func (c Client) url(username string) (string, error) {
+	base, err := url.Parse(c.Server)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid server url")
+	}
+	return base.JoinPath(username, "authorized_keys").String(), nil
+}
+
+// fetch fetches the file at target from the server
+func (c Client) fetch(ctx context.Context, target string) ([]byte, error) {
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(res.Body)
+	case http.StatusNotFound, http.StatusUnavailableForLegalReasons:
+		return nil, ErrUserNotFound
+	default:
+		return nil, errors.Errorf("server responded with %s", res.Status)
+	}
+}
+
+// cache returns the cache to store responses in.
+// When caching is disabled, returns nil.
+func (c Client) cache() *diskcache.Cache {
+	if c.CacheDir == "" {
+		return nil
+	}
+	return &diskcache.Cache{Dir: c.CacheDir}
+}
+
+// load loads the cached response for target
+func (c Client) load(target string) ([]byte, error) {
+	cache := c.cache()
+	if cache == nil {
+		return nil, os.ErrNotExist
+	}
+
+	keys, ok := cache.Get(target)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return keys, nil
+}
+
+// store atomically stores a response for target in the cache.
+// Failures are ignored, as the cache is only a fallback.
+func (c Client) store(target string, keys []byte) {
+	if cache := c.cache(); cache != nil {
+		cache.Set(target, keys)
+	}
+}
+
+// remove removes the cached response for target
+func (c Client) remove(target string) {
+	if cache := c.cache(); cache != nil {
+		cache.Delete(target)
+	}
+}
@@ -0,0 +1,208 @@
+// Package diskcache provides Cache
+package diskcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spellchecker:words diskcache httpcache
+
+// Cache is a cache that stores values as files inside a directory.
+// It implements the Cache interface of github.com/gregjones/httpcache.
+//
+// Every value is stored in a file named after the sha256 hash of its key.
+// Files are written atomically, so several processes may safely share the same directory.
+// However, when MaxSize is set, values stored by any of them may be removed.
+// Caches that must not evict each other's values should use separate directories.
+// Failures to read or write the directory are ignored, and treated like a missing value.
+//
+// The zero value is not ready to use, the Dir must be set.
+// Cache is safe for concurrent access.
+type Cache struct {
+	// Dir is the directory to store values in.
+	// It is created when the first value is stored.
+	Dir string
+
+	// MaxSize is the maximum total size of all values in bytes.
+	// When exceeded, the least recently stored values are removed.
+	// Values are never removed when MaxSize is not positive.
+	MaxSize int64
+
+	// MaxAge is the maximum age of values.
+	// Older values are treated as missing.
+	// Values never expire when MaxAge is not positive.
+	MaxAge time.Duration
+
+	lock    sync.Mutex
+	size    int64 // estimated total size of all values
+	scanned bool  // has size been initialized
+}
+
+// tmpPrefix is the prefix of temporary files within the cache directory
+const tmpPrefix = ".tmp-"
+
+// maxTmpAge is the age after which temporary files are assumed to be left over from a crash
+const maxTmpAge = time.Hour
+
+// path returns the path of the file that stores the value for key
+func (c *Cache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.Dir, hex.EncodeToString(hash[:]))
+}
+
+// Get returns the value stored for key, and a boolean indicating if it exists.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	path := c.path(key)
+
+	if c.MaxAge > 0 {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, false
+		}
+		if time.Since(info.ModTime()) > c.MaxAge {
+			c.Delete(key)
+			return nil, false
+		}
+	}
+
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// Set stores value for key.
+func (c *Cache) Set(key string, value []byte) {
+	path := c.path(key)
+
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return
+	}
+
+	// write into a temporary file, then rename it into place
+	tmp, err := os.CreateTemp(c.Dir, tmpPrefix+"*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		return
+	}
+
+	var previous int64
+	if info, err := os.Stat(path); err == nil {
+		previous = info.Size()
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return
+	}
+
+	c.grow(int64(len(value)) - previous)
+}
+
+// Delete removes the value stored for key.
+func (c *Cache) Delete(key string) {
+	path := c.path(key)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		return
+	}
+
+	c.grow(-info.Size())
+}
+
+// grow records that the total size of all values changed by delta.
+// When the estimated total size exceeds MaxSize, evicts values.
+func (c *Cache) grow(delta int64) {
+	if c.MaxSize <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.size += delta
+	if c.scanned && c.size <= c.MaxSize {
+		return
+	}
+
+	c.evict()
+}
+
+// evict scans the cache directory and removes the least recently stored values until the total size is below MaxSize.
+// The caller must hold the lock.
+//
+// As other processes may share the directory, the estimated size is reset to the actual size.
+func (c *Cache) evict() {
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return
+	}
+
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []file
+	var size int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(c.Dir, entry.Name())
+
+		// remove temporary files that were left behind
+		if strings.HasPrefix(entry.Name(), tmpPrefix) {
+			if time.Since(info.ModTime()) > maxTmpAge {
+				os.Remove(path)
+			}
+			continue
+		}
+
+		files = append(files, file{path: path, size: info.Size(), modTime: info.ModTime()})
+		size += info.Size()
+	}
+
+	// remove the oldest files first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, f := range files {
+		if size <= c.MaxSize {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		size -= f.size
+	}
+
+	c.size = size
+	c.scanned = true
+}
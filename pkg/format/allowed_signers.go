@@ -0,0 +1,150 @@
+package format
+
+import (
+	"net/http"
+	"strings"
+	"text/template"
+
+	_ "embed"
+
+	"github.com/pkg/errors"
+
+	"github.com/tkw1536/akhttpd/pkg/count"
+	"github.com/tkw1536/akhttpd/pkg/repo"
+)
+
+// spellchecker:words akhttpd
+
+// AllowedSigners is a struct that formats ssh keys as an OpenSSH allowed_signers file.
+// Such a file can be used to verify ssh signatures, e.g. using git's gpg.ssh.allowedSignersFile setting.
+// It implements Formatter and UsageFormatter.
+type AllowedSigners struct {
+	// Principal is a text/template that generates the principal of each key.
+	// It is passed a struct with fields User and Source, describing the user the key belongs to.
+	// When empty, uses "{{.User}}".
+	Principal string
+
+	// Namespaces is the comma-separated list of namespaces the keys may be used in.
+	// When empty, uses "git".
+	Namespaces string
+
+	// SigningKeys indicates that keys should be fetched for UsageSigning instead of UsageAuthentication.
+	// For GitHub users, this uses their ssh signing keys instead of their authentication keys.
+	SigningKeys bool
+}
+
+//go:embed allowed_signers.tpl
+var tplAllowedSigners string
+var fmtAllowedSigners = template.Must(template.New("allowed_signers").Parse(tplAllowedSigners))
+
+// allowedSignersContext is the context used to render the allowed_signers template
+type allowedSignersContext struct {
+	fmtContext
+	Signers []allowedSigner
+}
+
+// allowedSigner is a single line of the allowed_signers template
+type allowedSigner struct {
+	fmtKey
+	Principal  string
+	Namespaces string
+}
+
+// principalContext is passed to the Principal template
+type principalContext struct {
+	User   string
+	Source string
+}
+
+// Usage returns the usage of keys required by this formatter.
+func (as AllowedSigners) Usage() repo.Usage {
+	if as.SigningKeys {
+		return repo.UsageSigning
+	}
+	return repo.UsageAuthentication
+}
+
+var errInvalidPrincipal = errors.New("AllowedSigners: principal may not be empty or contain whitespace")
+
+// WriteTo writes the ssh keys, which are associated with the given user, into w.
+// They will be formatted in allowed_signers format and include an appropriate Content-Disposition header.
+// Returns the number of bytes written in the body of w and an error.
+func (as AllowedSigners) WriteTo(username, source string, keys []repo.Key, r *http.Request, w http.ResponseWriter) (int, error) {
+	fctx, err := newFmtContext(username, source, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	tpl, err := as.principalTemplate()
+	if err != nil {
+		return 0, err
+	}
+
+	namespaces := as.Namespaces
+	if namespaces == "" {
+		namespaces = "git"
+	}
+
+	ctx := allowedSignersContext{fmtContext: fctx, Signers: make([]allowedSigner, len(fctx.Keys))}
+	for i, key := range fctx.Keys {
+		// keys of merged users use their own principal
+		user := key.User
+		if user == "" {
+			user = username
+		}
+
+		principal, err := executePrincipal(tpl, principalContext{User: user, Source: key.Source})
+		if err != nil {
+			return 0, err
+		}
+
+		ctx.Signers[i] = allowedSigner{fmtKey: key, Principal: principal, Namespaces: namespaces}
+	}
+
+	headers := w.Header()
+	headers.Add("Content-Disposition", "attachment; filename=\"allowed_signers\"")
+	headers.Add("Content-Type", "text/plain")
+
+	return count.Count(w, func(cw *count.Writer) error {
+		return fmtAllowedSigners.Execute(cw, ctx)
+	})
+}
+
+// CheckPrincipal checks that Principal is a valid template, by generating the principal of an example user.
+// It should be called before using as, as an invalid template only causes WriteTo to fail.
+func (as AllowedSigners) CheckPrincipal() error {
+	tpl, err := as.principalTemplate()
+	if err != nil {
+		return err
+	}
+	_, err = executePrincipal(tpl, principalContext{User: "user", Source: "github"})
+	return err
+}
+
+// principalTemplate returns the template used to generate principals
+func (as AllowedSigners) principalTemplate() (*template.Template, error) {
+	principal := as.Principal
+	if principal == "" {
+		principal = "{{.User}}"
+	}
+
+	tpl, err := template.New("principal").Parse(principal)
+	if err != nil {
+		return nil, errors.Wrap(err, "AllowedSigners: invalid principal template")
+	}
+	return tpl, nil
+}
+
+// executePrincipal generates a principal using tpl and ctx
+func executePrincipal(tpl *template.Template, ctx principalContext) (string, error) {
+	var builder strings.Builder
+	if err := tpl.Execute(&builder, ctx); err != nil {
+		return "", errors.Wrap(err, "AllowedSigners: failed to execute principal template")
+	}
+
+	principal := builder.String()
+	if principal == "" || strings.ContainsAny(principal, " \t\r\n") {
+		return "", errInvalidPrincipal
+	}
+	return principal, nil
+}
@@ -0,0 +1,3 @@
+# allowed_signers for {{ .User }}, generated {{ .Time }}
+{{ range .Signers }}{{ .Principal }} namespaces="{{ .Namespaces }}" {{ .Type }} {{ .Blob }}
+{{ end }}
@@ -7,14 +7,17 @@ import (
 	_ "embed"
 
 	"github.com/tkw1536/akhttpd/pkg/count"
-	"golang.org/x/crypto/ssh"
+	"github.com/tkw1536/akhttpd/pkg/repo"
 )
 
 // spellchecker:words akhttpd
 
 // AuthorizedKeys is a struct that formats ssh keys as an authorized_keys file.
 // It implements Formatter.
-type AuthorizedKeys struct{}
+type AuthorizedKeys struct {
+	// Options are prepended to every key
+	Options KeyOptions
+}
 
 //go:embed authorized_keys.tpl
 var tplAuthorizedKeys string
@@ -22,9 +25,15 @@ var fmtAuthorizedKeys = template.Must(template.New("authorized_keys").Parse(tplA
 
 // WriteTo writes the ssh keys, which are associated with the given user, into w.
 // They will be formatted in authorized_keys format and include an appropriate Content-Disposition header.
+// Options configured in Options or requested by the client are prepended to every key.
 // Returns the number of bytes written in the body of w and an error.
-func (AuthorizedKeys) WriteTo(username, source string, keys []ssh.PublicKey, r *http.Request, w http.ResponseWriter) (int, error) {
-	ctx, err := newFmtContext(username, source, keys)
+func (ak AuthorizedKeys) WriteTo(username, source string, keys []repo.Key, r *http.Request, w http.ResponseWriter) (int, error) {
+	options, err := ak.Options.Resolve(r)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, err := newFmtContext(username, source, withOptions(keys, options))
 	if err != nil {
 		return 0, err
 	}
@@ -37,3 +46,9 @@ func (AuthorizedKeys) WriteTo(username, source string, keys []ssh.PublicKey, r *
 		return fmtAuthorizedKeys.Execute(cw, ctx)
 	})
 }
+
+// Validate checks that the options requested by r are valid and allowed.
+func (ak AuthorizedKeys) Validate(r *http.Request) error {
+	_, err := ak.Options.Resolve(r)
+	return err
+}
@@ -1,2 +1,3 @@
 # authorized_keys for {{ .User }}, generated {{ .Time }}
-{{ range .Keys }}{{.}}{{ end }}
+{{ range .Keys }}{{ if .User }}# {{ .User }}
+{{ end }}{{.Line}}{{ end }}
@@ -1,11 +1,14 @@
 package format
 
 import (
+	"encoding/base64"
 	"net/http"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 
+	"github.com/tkw1536/akhttpd/pkg/repo"
+
 	"github.com/mpolden/echoip/useragent"
 )
 
@@ -15,28 +18,95 @@ import (
 type Formatter interface {
 	// WriteTo writes the ssh keys, which are associated with the given user, into w.
 	// Returns the number of bytes written and an error.
-	WriteTo(username, source string, keys []ssh.PublicKey, r *http.Request, w http.ResponseWriter) (int, error)
+	WriteTo(username, source string, keys []repo.Key, r *http.Request, w http.ResponseWriter) (int, error)
+}
+
+// BadRequestError indicates that a Formatter could not format keys because the request was invalid.
+// The error message is intended to be shown to the client.
+type BadRequestError struct {
+	error
+}
+
+// Unwrap unwraps this error
+func (b BadRequestError) Unwrap() error {
+	return b.error
+}
+
+// UsageFormatter is a Formatter that requires keys for a specific usage.
+// Formatters that do not implement this interface receive keys for repo.UsageAuthentication.
+type UsageFormatter interface {
+	Formatter
+
+	// Usage returns the usage of keys required by this formatter.
+	Usage() repo.Usage
+}
+
+// VariantFormatter is a Formatter whose output depends on more than the keys and the query of the request.
+type VariantFormatter interface {
+	Formatter
+
+	// Variant returns a string identifying the representation that will be written in response to r.
+	Variant(r *http.Request) string
+
+	// Vary returns the names of the request headers the variant depends on.
+	// Callers should send these in the 'Vary' header of every response, including 304 Not Modified.
+	Vary() []string
+}
+
+// ValidatingFormatter is a Formatter that can check if a request is valid before any keys are fetched.
+type ValidatingFormatter interface {
+	Formatter
+
+	// Validate checks if r is valid.
+	// When it is not, returns a BadRequestError.
+	Validate(r *http.Request) error
 }
 
 // fmtContext is an object that is internally used to format values for the templates
 type fmtContext struct {
-	User   string
-	Source string
-	Time   time.Time
-	Keys   []string
+	User   string    `json:"user"`
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+	Keys   []fmtKey  `json:"keys"`
+}
+
+// fmtKey is a single key within a fmtContext
+type fmtKey struct {
+	Line string `json:"-"` // the key in authorized_keys format, including options, comment and trailing newline
+
+	Type    string   `json:"type"`              // the type of the key, e.g. "ssh-ed25519"
+	Blob    string   `json:"blob"`              // the base64-encoded key, as found in authorized_keys
+	Comment string   `json:"comment"`           // the comment of the key, if any
+	Options []string `json:"options,omitempty"` // the options of the key, if any
+	Source  string   `json:"source"`            // the source of the key
+	User    string   `json:"user,omitempty"`    // the user the key belongs to, only set when keys of several users are merged
+	Bits    int      `json:"bits"`              // the size of the key in bits, 0 if unknown
+	SHA256  string   `json:"sha256"`            // the SHA256 fingerprint of the key
+	MD5     string   `json:"md5"`               // the legacy MD5 fingerprint of the key
 }
 
 // newFmtContext returns a new format context
-func newFmtContext(username, source string, keys []ssh.PublicKey) (ctx fmtContext, err error) {
+func newFmtContext(username, source string, keys []repo.Key) (ctx fmtContext, err error) {
 	ctx.User = username
 	ctx.Source = source
 	ctx.Time = time.Now().UTC()
-	ctx.Keys = make([]string, 0, len(keys))
+	ctx.Keys = make([]fmtKey, 0, len(keys))
 
 	// format all the keys
 	for _, k := range keys {
-		key := ssh.MarshalAuthorizedKey(k)
-		ctx.Keys = append(ctx.Keys, string(key))
+		ctx.Keys = append(ctx.Keys, fmtKey{
+			Line: string(k.MarshalAuthorizedKey()),
+
+			Type:    k.PublicKey.Type(),
+			Blob:    base64.StdEncoding.EncodeToString(k.PublicKey.Marshal()),
+			Comment: k.Comment,
+			Options: k.Options,
+			Source:  k.Source,
+			User:    k.User,
+			Bits:    k.Bits(),
+			SHA256:  ssh.FingerprintSHA256(k.PublicKey),
+			MD5:     ssh.FingerprintLegacyMD5(k.PublicKey),
+		})
 	}
 	return
 }
@@ -47,13 +117,36 @@ type Magic struct {
 	AuthorizedKeys AuthorizedKeys
 }
 
-func (m Magic) WriteTo(username, source string, keys []ssh.PublicKey, r *http.Request, w http.ResponseWriter) (int, error) {
+// WriteTo writes keys using the formatter for r.
+// The caller is responsible for setting the 'Vary' header, see Vary.
+func (m Magic) WriteTo(username, source string, keys []repo.Key, r *http.Request, w http.ResponseWriter) (int, error) {
 	if m.isCliRequest(r) {
 		return m.AuthorizedKeys.WriteTo(username, source, keys, r, w)
 	}
 	return m.HTML.WriteTo(username, source, keys, r, w)
 }
 
+// Variant returns the name of the formatter used to respond to r.
+func (m Magic) Variant(r *http.Request) string {
+	if m.isCliRequest(r) {
+		return "authorized_keys"
+	}
+	return "html"
+}
+
+// Vary returns the request headers the variant depends on.
+func (Magic) Vary() []string {
+	return []string{"User-Agent"}
+}
+
+// Validate validates r using the formatter for r.
+func (m Magic) Validate(r *http.Request) error {
+	if m.isCliRequest(r) {
+		return m.AuthorizedKeys.Validate(r)
+	}
+	return nil
+}
+
 func (Magic) isCliRequest(r *http.Request) bool {
 	agent := useragent.Parse(r.UserAgent())
 	switch agent.Product {
@@ -4,10 +4,12 @@ import (
 	"io"
 	"net/http"
 	"text/template"
+	"time"
 
 	_ "embed"
 
 	"github.com/tkw1536/akhttpd/pkg/count"
+	"github.com/tkw1536/akhttpd/pkg/repo"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -18,6 +20,37 @@ import (
 type HTML struct {
 	// Suffix is called to write a suffix to the html response
 	Suffix func(w io.Writer) error
+
+	// Profiles maps the source of a user to the profile page to link to.
+	// When nil, uses DefaultProfiles.
+	Profiles map[string]Profile
+}
+
+// Profile describes where the profile page of users from a specific source can be found.
+type Profile struct {
+	Name string // human-readable name of the source, e.g. "GitHub"
+	URL  string // base url of user profiles, the username is appended to it, e.g. "https://github.com/"
+}
+
+// DefaultProfiles are the profiles used when HTML.Profiles is nil.
+var DefaultProfiles = map[string]Profile{
+	"github": {Name: "GitHub", URL: "https://github.com/"},
+}
+
+// htmlContext is the context used to render the html template
+type htmlContext struct {
+	fmtContext
+	Profile  Profile
+	Filtered []htmlFilteredKey
+	Stale    string // when the keys are stale, the time they were fetched
+}
+
+// htmlFilteredKey is a key that was filtered out by the repository
+type htmlFilteredKey struct {
+	Type   string
+	SHA256 string
+	User   string
+	Reason string
 }
 
 //go:embed html.min.tpl
@@ -27,12 +60,33 @@ var fmtHTMLTemplate = template.Must(template.New("authorized_keys.html").Parse(t
 // WriteTo writes the ssh keys, which are associated with the given user, into w.
 // They will be formatted as a shell script that updates or creates the file '.ssh/authorized_keys' and include an appropriate Content-Disposition header.
 // Returns the number of bytes written in the body of w and an error.
-func (h HTML) WriteTo(username, source string, keys []ssh.PublicKey, r *http.Request, w http.ResponseWriter) (int, error) {
-	ctx, err := newFmtContext(username, source, keys)
+func (h HTML) WriteTo(username, source string, keys []repo.Key, r *http.Request, w http.ResponseWriter) (int, error) {
+	fctx, err := newFmtContext(username, source, keys)
 	if err != nil {
 		return 0, err
 	}
 
+	profiles := h.Profiles
+	if profiles == nil {
+		profiles = DefaultProfiles
+	}
+	ctx := htmlContext{fmtContext: fctx, Profile: profiles[source]}
+
+	report := repo.ReportFromContext(r.Context())
+	if fetched, stale := report.Stale(); stale {
+		ctx.Stale = fetched.UTC().Format(time.RFC1123)
+	}
+
+	// report any keys that were filtered
+	for _, fk := range report.Filtered() {
+		ctx.Filtered = append(ctx.Filtered, htmlFilteredKey{
+			Type:   fk.Key.PublicKey.Type(),
+			SHA256: ssh.FingerprintSHA256(fk.Key.PublicKey),
+			User:   fk.User,
+			Reason: fk.Reason,
+		})
+	}
+
 	headers := w.Header()
 	headers.Add("Content-Type", "text/html")
 
@@ -1 +1 @@
-<!doctype html><html lang=en><title>User {{.User}} - akhttpd - Authorized Keys HTTP Daemon</title><style>body{font-family:-apple-system,BlinkMacSystemFont,"Segoe UI",Roboto,Oxygen-Sans,Ubuntu,Cantarell,"Helvetica Neue",sans-serif;line-height:1.5;color:#000;background:#fff}a{color:#000;text-decoration:underline}code{background:#d3d3d3;padding:5px}code.key,code.replace{user-select:all}code.block{margin:10px}</style><p>This page contains a list of SSH Keys for the {{if eq (.Source) ("github") }}<a href="https://github.com/{{ .User }}" target="_blank" rel="noreferrer noopener">GitHub User {{.User}}</a>{{else}}<a>User {{.User}}</a>{{end}}. This page is powered by <a href=/ >akhttpd</a>.<p>Click each entry to copy it to the clipboard.</p>{{ range .Keys }}<pre><code class="block key">{{.}}</code></pre>{{end}}<p>To install these keys on an ssh server, you could do something like:<p><code class="block replace">curl -L localhost:8080/{{.User}} > .ssh/authorized_keys</code><p>For convenience, this service also exposes a script to do this automatically. Using this script will overwrite any existing SSH Keys for your user. You can use it like:<p><code class="block replace">curl -L localhost:8080/{{.User}}.sh | sh</code></p><script>!function(t){for(var e=function(){var t=this.innerText.trim();navigator.clipboard?navigator.clipboard.writeText(t):prompt("Copy to Clipboard",t)},i=0;i<t.length;i++)t[i].addEventListener("click",e)}(document.getElementsByClassName("key"))</script><script>!function(o){for(var e,l,t,n,a=0;a<o.length;a++)e=o[a],l=void 0,l=e.innerHTML,t=location.host,n=location.protocol+"//"+t,e.innerHTML=l.replace("http://localhost:8080",n).replace("localhost:8080",t)}(document.getElementsByClassName("replace"))</script>
\ No newline at end of file
+<!doctype html><html lang=en><title>User {{.User}} - akhttpd - Authorized Keys HTTP Daemon</title><style>body{font-family:-apple-system,BlinkMacSystemFont,"Segoe UI",Roboto,Oxygen-Sans,Ubuntu,Cantarell,"Helvetica Neue",sans-serif;line-height:1.5;color:#000;background:#fff}a{color:#000;text-decoration:underline}code{background:#d3d3d3;padding:5px}code.key,code.replace{user-select:all}code.block{margin:10px}</style><p>This page contains a list of SSH Keys for the {{if .Profile.URL }}<a href="{{ .Profile.URL }}{{ .User }}" target="_blank" rel="noreferrer noopener">{{ .Profile.Name }} User {{.User}}</a>{{else}}<a>User {{.User}}</a>{{end}}. This page is powered by <a href=/ >akhttpd</a>.{{with .Stale}}<p><strong>Warning:</strong> The keys could not be fetched just now. The keys below were last fetched at {{.}} and may be outdated.{{end}}<p>Click each entry to copy it to the clipboard.</p>{{ range .Keys }}{{if .User}}<p>Key of user <em>{{html .User}}</em>:</p>{{end}}<pre><code class="block key">{{html .Line}}</code></pre>{{end}}{{with .Filtered}}<p>{{len .}} key(s) were filtered out:<ul>{{range .}}<li><code>{{.Type}} {{.SHA256}}</code> of user <em>{{html .User}}</em>: {{html .Reason}}</li>{{end}}</ul>{{end}}<p>To install these keys on an ssh server, you could do something like:<p><code class="block replace">curl -L localhost:8080/{{.User}} > .ssh/authorized_keys</code><p>For convenience, this service also exposes a script to do this automatically. Using this script will overwrite any existing SSH Keys for your user. You can use it like:<p><code class="block replace">curl -L localhost:8080/{{.User}}.sh | sh</code></p><script>!function(t){for(var e=function(){var t=this.innerText.trim();navigator.clipboard?navigator.clipboard.writeText(t):prompt("Copy to Clipboard",t)},i=0;i<t.length;i++)t[i].addEventListener("click",e)}(document.getElementsByClassName("key"))</script><script>!function(o){for(var e,l,t,n,a=0;a<o.length;a++)e=o[a],l=void 0,l=e.innerHTML,t=location.host,n=location.protocol+"//"+t,e.innerHTML=l.replace("http://localhost:8080",n).replace("localhost:8080",t)}(document.getElementsByClassName("replace"))</script>
\ No newline at end of file
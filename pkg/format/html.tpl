@@ -29,22 +29,39 @@
 </style>
 <p>
     This page contains a list of SSH Keys for the
-    {{if eq (.Source) ("github") }}
-        <a href="https://github.com/{{ .User }}" target="_blank" rel="noreferrer noopener">GitHub User {{.User}}</a>
+    {{if .Profile.URL }}
+        <a href="{{ .Profile.URL }}{{ .User }}" target="_blank" rel="noreferrer noopener">{{ .Profile.Name }} User {{.User}}</a>
     {{else}}
         <a>User {{.User}}</a>
     {{end}}. 
     This page is powered by <a href="/">akhttpd</a>.
 </p>
+{{ with .Stale }}
+<p>
+    <strong>Warning:</strong> The keys could not be fetched just now.
+    The keys below were last fetched at {{ . }} and may be outdated.
+</p>
+{{ end }}
 <p>
     Click each entry to copy it to the clipboard.
 </p>
 <ul>
 {{ range .Keys }}
-<li><pre><code class="block key">{{.}}</code></pre></li>
+<li>{{ if .User }}<p>Key of user <em>{{ html .User }}</em>:</p>{{ end }}<pre><code class="block key">{{ html .Line }}</code></pre></li>
 {{end}}
 </ul>
 
+{{ with .Filtered }}
+<p>
+    {{ len . }} key(s) were filtered out:
+</p>
+<ul>
+{{ range . }}
+<li><code>{{ .Type }} {{ .SHA256 }}</code> of user <em>{{ html .User }}</em>: {{ html .Reason }}</li>
+{{ end }}
+</ul>
+{{ end }}
+
 <p>
     To install these keys on an ssh server, you could do something like:
 </p>
@@ -0,0 +1,33 @@
+package format
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/tkw1536/akhttpd/pkg/count"
+	"github.com/tkw1536/akhttpd/pkg/repo"
+)
+
+// spellchecker:words akhttpd
+
+// JSON is a zero-size struct that formats ssh keys as a machine-readable json document.
+// Next to the keys themselves, the document contains metadata such as the type, size and fingerprints of each key.
+// It implements Formatter.
+type JSON struct{}
+
+// WriteTo writes the ssh keys, which are associated with the given user, into w.
+// They will be formatted as a json document.
+// Returns the number of bytes written in the body of w and an error.
+func (JSON) WriteTo(username, source string, keys []repo.Key, r *http.Request, w http.ResponseWriter) (int, error) {
+	ctx, err := newFmtContext(username, source, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	headers := w.Header()
+	headers.Add("Content-Type", "application/json")
+
+	return count.Count(w, func(cw *count.Writer) error {
+		return json.NewEncoder(cw).Encode(ctx)
+	})
+}
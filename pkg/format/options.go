@@ -0,0 +1,215 @@
+package format
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/tkw1536/akhttpd/pkg/repo"
+)
+
+// spellchecker:words permitopen permitlisten
+
+// KeyOptions configures authorized_keys options to prepend to every served key.
+//
+// Options are given in authorized_keys syntax, e.g. `restrict,from="10.0.0.0/8"`.
+// Only options understood by OpenSSH are accepted.
+type KeyOptions struct {
+	// Default are options prepended to every key.
+	Default string
+
+	// Allowed are the names of options that clients may additionally request using the 'options' query parameter.
+	// Names must be lower case, see ParseOptionNames.
+	// When nil, uses RestrictiveOptions.
+	Allowed []string
+}
+
+// RestrictiveOptions are the names of options that only restrict what a key may be used for.
+var RestrictiveOptions = []string{
+	"restrict",
+	"no-agent-forwarding",
+	"no-port-forwarding",
+	"no-pty",
+	"no-user-rc",
+	"no-x11-forwarding",
+	"from",
+	"expiry-time",
+	"permitopen",
+	"permitlisten",
+	"verify-required",
+}
+
+// knownOptions maps the names of all options understood by OpenSSH to if they require a value
+var knownOptions = map[string]bool{
+	"agent-forwarding":    false,
+	"cert-authority":      false,
+	"command":             true,
+	"environment":         true,
+	"expiry-time":         true,
+	"from":                true,
+	"no-agent-forwarding": false,
+	"no-port-forwarding":  false,
+	"no-pty":              false,
+	"no-touch-required":   false,
+	"no-user-rc":          false,
+	"no-x11-forwarding":   false,
+	"permitlisten":        true,
+	"permitopen":          true,
+	"port-forwarding":     false,
+	"principals":          true,
+	"pty":                 false,
+	"restrict":            false,
+	"tunnel":              true,
+	"user-rc":             false,
+	"verify-required":     false,
+	"x11-forwarding":      false,
+}
+
+// Resolve returns the options to prepend to every key served in response to r.
+// These consist of the default options, followed by the options requested in the 'options' query parameter.
+//
+// When the requested options are invalid or not allowed, returns a BadRequestError.
+func (ko KeyOptions) Resolve(r *http.Request) ([]string, error) {
+	options, err := ParseOptions(ko.Default)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid default options")
+	}
+
+	query := r.URL.Query().Get("options")
+	if query == "" {
+		return options, nil
+	}
+
+	extra, err := ParseOptions(query)
+	if err != nil {
+		return nil, BadRequestError{err}
+	}
+
+	allowed := ko.Allowed
+	if allowed == nil {
+		allowed = RestrictiveOptions
+	}
+	for _, option := range extra {
+		name, _, _ := strings.Cut(option, "=")
+		if !slices.Contains(allowed, strings.ToLower(name)) {
+			return nil, BadRequestError{errors.Errorf("option %q is not allowed", name)}
+		}
+	}
+
+	return append(options, extra...), nil
+}
+
+// ParseOptionNames normalizes names of options to lower case, and checks that they are understood by OpenSSH.
+func ParseOptionNames(names []string) ([]string, error) {
+	result := make([]string, len(names))
+	for i, name := range names {
+		result[i] = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := knownOptions[result[i]]; !ok {
+			return nil, errors.Errorf("unknown option %q", name)
+		}
+	}
+	return result, nil
+}
+
+// ParseOptions parses and validates a comma-separated list of authorized_keys options.
+// Values of options must be enclosed in double quotes.
+func ParseOptions(value string) (options []string, err error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	for {
+		end, err := optionEnd(value)
+		if err != nil {
+			return nil, err
+		}
+
+		option := value[:end]
+		if err := validateOption(option); err != nil {
+			return nil, err
+		}
+		options = append(options, option)
+
+		if end == len(value) {
+			return options, nil
+		}
+		value = value[end+1:]
+	}
+}
+
+// optionEnd returns the index of the comma ending the first option in value.
+// If there is no such comma, returns len(value).
+func optionEnd(value string) (int, error) {
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && quoted:
+			i++ // skip the escaped character
+		case value[i] == '"':
+			quoted = !quoted
+		case value[i] == ',' && !quoted:
+			return i, nil
+		}
+	}
+	if quoted {
+		return 0, errors.Errorf("unterminated quote in options %q", value)
+	}
+	return len(value), nil
+}
+
+// validateOption validates a single option
+func validateOption(option string) error {
+	name, arg, hasArg := strings.Cut(option, "=")
+
+	needsArg, ok := knownOptions[strings.ToLower(name)]
+	if !ok {
+		return errors.Errorf("unknown option %q", name)
+	}
+
+	switch {
+	case needsArg && !hasArg:
+		return errors.Errorf("option %q requires a value", name)
+	case !needsArg && hasArg:
+		return errors.Errorf("option %q does not take a value", name)
+	case hasArg && !isQuoted(arg):
+		return errors.Errorf("value of option %q must be quoted", name)
+	case strings.ContainsAny(option, "\r\n\x00"):
+		return errors.Errorf("option %q contains invalid characters", name)
+	}
+
+	return nil
+}
+
+// isQuoted checks if value is a single double-quoted string.
+// Double quotes within the string must be escaped using a backslash.
+func isQuoted(value string) bool {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return false
+	}
+	for i := 1; i < len(value)-1; i++ {
+		switch value[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case '"':
+			return false
+		}
+	}
+	return true
+}
+
+// withOptions returns a copy of keys, with options prepended to each key
+func withOptions(keys []repo.Key, options []string) []repo.Key {
+	if len(options) == 0 {
+		return keys
+	}
+
+	result := make([]repo.Key, len(keys))
+	for i, key := range keys {
+		key.Options = append(slices.Clip(options), key.Options...)
+		result[i] = key
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+package format
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// spellchecker:words permitopen
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"whitespace", "  ", nil, false},
+		{"single flag", "restrict", []string{"restrict"}, false},
+		{"several flags", "restrict,no-pty", []string{"restrict", "no-pty"}, false},
+		{"mixed case", "No-Pty", []string{"No-Pty"}, false},
+		{"quoted value", `from="10.0.0.0/8"`, []string{`from="10.0.0.0/8"`}, false},
+		{"comma in quoted value", `from="10.0.0.0/8,192.168.0.0/16",no-pty`, []string{`from="10.0.0.0/8,192.168.0.0/16"`, "no-pty"}, false},
+		{"escaped quote", `command="echo \"hi\""`, []string{`command="echo \"hi\""`}, false},
+		{"escaped quote and comma", `command="echo \",\"",no-pty`, []string{`command="echo \",\""`, "no-pty"}, false},
+
+		{"unknown option", "frobnicate", nil, true},
+		{"unknown option with value", `frobnicate="x"`, nil, true},
+		{"missing value", "from", nil, true},
+		{"unexpected value", `no-pty="x"`, nil, true},
+		{"unquoted value", "from=10.0.0.0/8", nil, true},
+		{"unterminated quote", `from="10.0.0.0/8`, nil, true},
+		{"unescaped quote in value", `command="a"b"`, nil, true},
+		{"quote after value", `from="10.0.0.0/8"" ssh-ed25519`, nil, true},
+		{"escaped closing quote", `command="a\"`, nil, true},
+		{"newline", "from=\"10.0.0.0/8\"\ncommand=\"sh\"", nil, true},
+		{"nul byte", "from=\"10.0.0.0/8\x00\"", nil, true},
+		{"empty option", "restrict,,no-pty", nil, true},
+		{"trailing comma", "restrict,", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOptions(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseOptions() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyOptions_Resolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		options KeyOptions
+		query   string
+		want    []string
+		wantErr bool
+	}{
+		{"default only", KeyOptions{Default: "restrict"}, "", []string{"restrict"}, false},
+		{"allowed option", KeyOptions{Default: "restrict"}, `from="10.0.0.0/8"`, []string{"restrict", `from="10.0.0.0/8"`}, false},
+		{"allowed option in upper case", KeyOptions{}, "NO-PTY", []string{"NO-PTY"}, false},
+		{"explicitly allowed option", KeyOptions{Allowed: []string{"command"}}, `command="uptime"`, []string{`command="uptime"`}, false},
+
+		{"disallowed option", KeyOptions{}, `command="sh"`, nil, true},
+		{"disallowed option in upper case", KeyOptions{}, `COMMAND="sh"`, nil, true},
+		{"disallowed by explicit list", KeyOptions{Allowed: []string{"from"}}, "no-pty", nil, true},
+		{"disallowed option after allowed one", KeyOptions{}, `no-pty,command="sh"`, nil, true},
+		{"option smuggled into quoted value", KeyOptions{}, `from="x",command="sh"`, nil, true},
+		{"unknown option", KeyOptions{}, "frobnicate", nil, true},
+		{"invalid option", KeyOptions{}, `from="x`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/user?options="+url.QueryEscape(tt.query), nil)
+
+			got, err := tt.options.Resolve(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, isBadRequest := err.(BadRequestError); tt.wantErr && !isBadRequest {
+				t.Errorf("Resolve() error = %v, want a BadRequestError", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOptionNames(t *testing.T) {
+	got, err := ParseOptionNames([]string{"From", " no-pty ", "PERMITOPEN"})
+	if err != nil {
+		t.Fatalf("ParseOptionNames() error = %v", err)
+	}
+	if want := []string{"from", "no-pty", "permitopen"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseOptionNames() = %q, want %q", got, want)
+	}
+
+	if _, err := ParseOptionNames([]string{"from", "frobnicate"}); err == nil {
+		t.Error("ParseOptionNames() error = nil, want an error")
+	}
+}
@@ -7,14 +7,17 @@ import (
 	_ "embed"
 
 	"github.com/tkw1536/akhttpd/pkg/count"
-	"golang.org/x/crypto/ssh"
+	"github.com/tkw1536/akhttpd/pkg/repo"
 )
 
 // spellchecker:words akhttpd
 
-// ShellScript is a zero-size struct that formats ssh keys as a shell script updating an authorized_keys file.
+// ShellScript is a struct that formats ssh keys as a shell script updating an authorized_keys file.
 // It implements Formatter.
-type ShellScript struct{}
+type ShellScript struct {
+	// Options are prepended to every key
+	Options KeyOptions
+}
 
 //go:embed shellscript.tpl
 var tplShellTemplate string
@@ -22,9 +25,15 @@ var fmtShellTemplate = template.Must(template.New("authorized_keys.sh").Parse(tp
 
 // WriteTo writes the ssh keys, which are associated with the given user, into w.
 // They will be formatted as a shell script that updates or creates the file '.ssh/authorized_keys' and include an appropriate Content-Disposition header.
+// Options configured in Options or requested by the client are prepended to every key.
 // Returns the number of bytes written in the body of w and an error.
-func (ShellScript) WriteTo(username, source string, keys []ssh.PublicKey, r *http.Request, w http.ResponseWriter) (int, error) {
-	ctx, err := newFmtContext(username, source, keys)
+func (ss ShellScript) WriteTo(username, source string, keys []repo.Key, r *http.Request, w http.ResponseWriter) (int, error) {
+	options, err := ss.Options.Resolve(r)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, err := newFmtContext(username, source, withOptions(keys, options))
 	if err != nil {
 		return 0, err
 	}
@@ -37,3 +46,9 @@ func (ShellScript) WriteTo(username, source string, keys []ssh.PublicKey, r *htt
 		return fmtShellTemplate.Execute(cw, ctx)
 	})
 }
+
+// Validate checks that the options requested by r are valid and allowed.
+func (ss ShellScript) Validate(r *http.Request) error {
+	_, err := ss.Options.Resolve(r)
+	return err
+}
@@ -12,8 +12,9 @@ echo "Creating and fixing permissions of '{{ "$SSH_DIR" }}' ..."
 mkdir -p "{{ "$SSH_DIR" }}"
 chmod 700 "{{ "$SSH_DIR" }}"
 echo "Writing '{{ "$AK_FILE" }}' ..."
-cat > "{{ "$AK_FILE" }}" <<AUTHORIZEDKEYS
-{{ range .Keys }}{{.}}{{ end }}
+cat > "{{ "$AK_FILE" }}" <<'AUTHORIZEDKEYS'
+{{ range .Keys }}{{ if .User }}# {{ .User }}
+{{ end }}{{.Line}}{{ end }}
 AUTHORIZEDKEYS
 echo "Fixing permissions of '{{ "$AK_FILE" }}'"
 chmod 644 "{{ "$AK_FILE" }}"
\ No newline at end of file
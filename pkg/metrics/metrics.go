@@ -0,0 +1,266 @@
+// Package metrics provides metrics that can be exposed in the Prometheus text format.
+//
+// Metrics are registered globally when they are created, and exposed using Handler.
+package metrics
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tkw1536/akhttpd/pkg/count"
+)
+
+// spellchecker:words akhttpd
+
+// metric is a metric that can be exposed
+type metric interface {
+	// writeTo writes the metric in Prometheus text format into w
+	writeTo(w io.Writer)
+}
+
+var registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+// register registers a new metric
+func register(m metric) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.metrics = append(registry.metrics, m)
+}
+
+// Handler returns an http.Handler that exposes all metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		registry.lock.Lock()
+		metrics := append([]metric(nil), registry.metrics...)
+		registry.lock.Unlock()
+
+		count.Count(w, func(cw *count.Writer) error {
+			for _, m := range metrics {
+				m.writeTo(cw)
+			}
+			return nil
+		})
+	})
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric
+func writeHeader(w io.Writer, name, help, tp string) {
+	io.WriteString(w, "# HELP "+name+" "+strings.ReplaceAll(help, "\n", " ")+"\n")
+	io.WriteString(w, "# TYPE "+name+" "+tp+"\n")
+}
+
+// writeSample writes a single sample
+func writeSample(w io.Writer, name string, labels []string, values []string, value float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i, label := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, label+"=\""+labelEscaper.Replace(values[i])+"\"")
+		}
+		io.WriteString(w, "}")
+	}
+	io.WriteString(w, " "+formatFloat(value)+"\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatFloat formats a float for the text format
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, +1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// vec stores one value per combination of label values
+type vec[V any] struct {
+	lock   sync.Mutex
+	values map[string]*labelled[V]
+}
+
+type labelled[V any] struct {
+	labels []string
+	value  V
+}
+
+// get returns the value for the given label values, creating it if needed.
+// The caller must hold the lock.
+func (v *vec[V]) get(values []string, create func() V) *V {
+	key := strings.Join(values, "\x00")
+	if v.values == nil {
+		v.values = make(map[string]*labelled[V])
+	}
+	lv, ok := v.values[key]
+	if !ok {
+		lv = &labelled[V]{labels: append([]string(nil), values...), value: create()}
+		v.values[key] = lv
+	}
+	return &lv.value
+}
+
+// sorted returns all values sorted by their labels.
+// The caller must hold the lock.
+func (v *vec[V]) sorted() []*labelled[V] {
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]*labelled[V], len(keys))
+	for i, key := range keys {
+		values[i] = v.values[key]
+	}
+	return values
+}
+
+// CounterVec is a counter partitioned by a set of labels.
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	vec vec[float64]
+}
+
+// NewCounterVec creates and registers a new CounterVec.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels}
+	register(c)
+	return c
+}
+
+// Inc increments the counter with the given label values.
+// values must have the same length as the labels the counter was created with.
+func (c *CounterVec) Inc(values ...string) {
+	c.vec.lock.Lock()
+	defer c.vec.lock.Unlock()
+
+	*c.vec.get(values, func() float64 { return 0 })++
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+	c.vec.lock.Lock()
+	defer c.vec.lock.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, lv := range c.vec.sorted() {
+		writeSample(w, c.name, c.labels, lv.labels, lv.value)
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	name, help string
+
+	lock  sync.Mutex
+	value float64
+}
+
+// NewGauge creates and registers a new Gauge.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(g)
+	return g
+}
+
+// Add adds delta to the gauge.
+func (g *Gauge) Add(delta float64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.value += delta
+}
+
+func (g *Gauge) writeTo(w io.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+	writeSample(w, g.name, nil, nil, g.value)
+}
+
+// DefaultBuckets are the default buckets of a histogram, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// HistogramVec is a histogram partitioned by a set of labels.
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	vec vec[histogram]
+}
+
+type histogram struct {
+	counts []uint64 // counts[i] is the number of observations <= buckets[i]
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec creates and registers a new HistogramVec.
+// When buckets is nil, uses DefaultBuckets.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets}
+	register(h)
+	return h
+}
+
+// Observe adds a single observation to the histogram with the given label values.
+// values must have the same length as the labels the histogram was created with.
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	h.vec.lock.Lock()
+	defer h.vec.lock.Unlock()
+
+	hist := h.vec.get(values, func() histogram {
+		return histogram{counts: make([]uint64, len(h.buckets))}
+	})
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += value
+	hist.count++
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	h.vec.lock.Lock()
+	defer h.vec.lock.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, lv := range h.vec.sorted() {
+		values := append(append([]string(nil), lv.labels...), "")
+		for i, bound := range h.buckets {
+			values[len(values)-1] = formatFloat(bound)
+			writeSample(w, h.name+"_bucket", labels, values, float64(lv.value.counts[i]))
+		}
+		values[len(values)-1] = "+Inf"
+		writeSample(w, h.name+"_bucket", labels, values, float64(lv.value.count))
+
+		writeSample(w, h.name+"_sum", h.labels, lv.labels, lv.value.sum)
+		writeSample(w, h.name+"_count", h.labels, lv.labels, float64(lv.value.count))
+	}
+}
@@ -3,8 +3,6 @@ package repo
 import (
 	"context"
 	"strings"
-
-	"golang.org/x/crypto/ssh"
 )
 
 // Blocklisted represents a KeyRepository that blocks a list of user for legal reasons
@@ -15,7 +13,7 @@ type Blocklisted struct {
 }
 
 // GetKeys resolves and returns the keys for the provided username.
-func (b *Blocklisted) GetKeys(context context.Context, username string) (string, []ssh.PublicKey, error) {
+func (b *Blocklisted) GetKeys(context context.Context, username string) (string, []Key, error) {
 	// check if the user is blacklisted
 	for _, user := range b.Blocked {
 		if strings.EqualFold(user, username) {
@@ -0,0 +1,136 @@
+package repo
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/die-net/lrucache"
+	"github.com/gregjones/httpcache"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/akhttpd/pkg/metrics"
+	"golang.org/x/oauth2"
+)
+
+// spellchecker:words lrucache gregjones httpcache
+
+// newCache returns cache, or if it is nil an in-memory cache of maxCacheSize bytes that stores values for at most maxCacheAge.
+func newCache(cache httpcache.Cache, maxCacheSize int64, maxCacheAge time.Duration) httpcache.Cache {
+	if cache != nil {
+		return cache
+	}
+	return lrucache.New(
+		maxCacheSize,
+		int64(maxCacheAge.Seconds()),
+	)
+}
+
+// newCachingClient creates a new http.Client for the named upstream that authenticates using the given bearer token (if any).
+// Responses are cached in the given cache.
+//
+// Latency of upstream requests as well as cache hits and misses are recorded as metrics.
+func newCachingClient(upstream string, token string, timeout time.Duration, cache httpcache.Cache) *http.Client {
+	// using a token requires use of a transport.
+	// we create one using oauth2.NewClient().
+	var oauthTransport http.RoundTripper
+	if token != "" {
+		oauthTransport = oauth2.NewClient(
+			context.Background(),
+			oauth2.StaticTokenSource(
+				&oauth2.Token{AccessToken: token},
+			),
+		).Transport
+	}
+
+	// create a new (cached) transport
+	// based on the client above
+	transport := &httpcache.Transport{
+		Transport:           latencyTransport{upstream: upstream, Transport: oauthTransport},
+		Cache:               cache,
+		MarkCachedResponses: true,
+	}
+
+	// finally make an http client with that cache
+	// and the timeout above.
+	return &http.Client{
+		Transport: cacheResultTransport{upstream: upstream, Transport: transport},
+		Timeout:   timeout,
+	}
+}
+
+// checkUpstream checks that the upstream API at target is reachable using client.
+// Any response that does not indicate a server error is considered successful.
+func checkUpstream(ctx context.Context, client *http.Client, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+
+	// always contact the upstream, and do not store the response
+	req.Header.Set("Cache-Control", "no-cache, no-store")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return wrapUpstreamError(ctx, err, "upstream unreachable")
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return errors.Errorf("upstream responded with %s", res.Status)
+	}
+	return nil
+}
+
+var upstreamRequestDuration = metrics.NewHistogramVec(
+	"akhttpd_upstream_request_duration_seconds",
+	"Latency of requests to upstream APIs, such as the GitHub API, that were not served from cache.",
+	nil,
+	"upstream",
+)
+
+var upstreamCacheResponses = metrics.NewCounterVec(
+	"akhttpd_upstream_cache_responses_total",
+	"Number of responses from upstream APIs by if they were served from cache.",
+	"upstream", "result",
+)
+
+// latencyTransport is an http.RoundTripper that records the latency of requests
+type latencyTransport struct {
+	upstream  string
+	Transport http.RoundTripper // underlying transport, when nil uses http.DefaultTransport
+}
+
+func (lt latencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := lt.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	start := time.Now()
+	defer func() {
+		upstreamRequestDuration.Observe(time.Since(start).Seconds(), lt.upstream)
+	}()
+
+	return transport.RoundTrip(req)
+}
+
+// cacheResultTransport is an http.RoundTripper that records if responses of an underlying httpcache.Transport were cached
+type cacheResultTransport struct {
+	upstream  string
+	Transport *httpcache.Transport
+}
+
+func (ct cacheResultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := ct.Transport.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+
+	result := "miss"
+	if res.Header.Get(httpcache.XFromCache) != "" {
+		result = "hit"
+	}
+	upstreamCacheResponses.Inc(ct.upstream, result)
+
+	return res, err
+}
@@ -0,0 +1,102 @@
+package repo
+
+import (
+	"context"
+	"sync"
+)
+
+// Coalesced is a KeyRepository that coalesces concurrent calls to GetKeys for the same user.
+// Only a single call to the underlying repository is made, and all callers receive its result.
+//
+// Each caller stops waiting once its own context is done.
+// The underlying call is only cancelled once all callers have stopped waiting.
+//
+// The zero value is not ready to use, the Repository must be set.
+// Coalesced is safe for concurrent access.
+type Coalesced struct {
+	Repository KeyRepository
+
+	lock  sync.Mutex
+	calls map[userKey]*coalescedCall
+}
+
+// coalescedCall is a call to the underlying repository of Coalesced
+type coalescedCall struct {
+	done   chan struct{} // closed once the call has returned
+	cancel context.CancelFunc
+
+	waiters int // number of callers waiting, guarded by the lock of Coalesced
+
+	source string
+	keys   []Key
+	err    error
+}
+
+// GetKeys resolves and returns the keys for the provided username.
+func (c *Coalesced) GetKeys(context context.Context, username string) (string, []Key, error) {
+	key := userKey{Usage: UsageFromContext(context), Username: username}
+
+	call := c.join(context, key)
+	select {
+	case <-call.done:
+		return call.source, append([]Key(nil), call.keys...), call.err
+	case <-context.Done():
+		c.leave(key, call)
+		return "", nil, wrapUpstreamError(context, context.Err(), "waiting for keys failed")
+	}
+}
+
+// join joins the in-progress call for key, or starts a new one
+func (c *Coalesced) join(ctx context.Context, key userKey) *coalescedCall {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	call, ok := c.calls[key]
+	if !ok {
+		// the call retains the values of ctx, but must not be cancelled by it.
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+		call = &coalescedCall{done: make(chan struct{}), cancel: cancel}
+		if c.calls == nil {
+			c.calls = make(map[userKey]*coalescedCall)
+		}
+		c.calls[key] = call
+
+		go c.do(callCtx, key, call)
+	}
+
+	call.waiters++
+	return call
+}
+
+// do performs call using the underlying repository
+func (c *Coalesced) do(ctx context.Context, key userKey, call *coalescedCall) {
+	defer call.cancel()
+
+	call.source, call.keys, call.err = c.Repository.GetKeys(ctx, key.Username)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	close(call.done)
+}
+
+// leave stops waiting for call.
+// When no callers are left, cancels it.
+func (c *Coalesced) leave(key userKey, call *coalescedCall) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+
+	call.cancel()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+}
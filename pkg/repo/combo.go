@@ -2,8 +2,6 @@ package repo
 
 import (
 	"context"
-
-	"golang.org/x/crypto/ssh"
 )
 
 // Combo combines an array of KeyRepositories by trying each in order.
@@ -12,7 +10,7 @@ type Combo []KeyRepository
 
 // GetKeys resolves and returns the keys for the provided username.
 // When a user cannot be found, returns the appropriate error of the last user
-func (c Combo) GetKeys(context context.Context, username string) (source string, keys []ssh.PublicKey, err error) {
+func (c Combo) GetKeys(context context.Context, username string) (source string, keys []Key, err error) {
 	for _, r := range c {
 		source, keys, err = r.GetKeys(context, username)
 
@@ -25,3 +23,18 @@ func (c Combo) GetKeys(context context.Context, username string) (source string,
 	// return the last error!
 	return
 }
+
+// Check checks each of the repositories that implement Checker in order.
+// It returns the first error encountered.
+func (c Combo) Check(ctx context.Context) error {
+	for _, r := range c {
+		checker, ok := r.(Checker)
+		if !ok {
+			continue
+		}
+		if err := checker.Check(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
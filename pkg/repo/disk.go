@@ -4,8 +4,6 @@ import (
 	"context"
 	"io/fs"
 	"os"
-
-	"golang.org/x/crypto/ssh"
 )
 
 // Disk reads keys from files named on disk
@@ -17,7 +15,7 @@ func (d Disk) path(username string) (path string) {
 	return username
 }
 
-func (d Disk) GetKeys(context context.Context, username string) (source string, keys []ssh.PublicKey, err error) {
+func (d Disk) GetKeys(context context.Context, username string) (source string, keys []Key, err error) {
 	bytes, err := fs.ReadFile(d.FS, d.path(username))
 	if os.IsNotExist(err) {
 		return "", nil, UserNotFoundError{error: err}
@@ -25,18 +23,11 @@ func (d Disk) GetKeys(context context.Context, username string) (source string,
 	if err != nil {
 		return "", nil, err
 	}
-	return "disk", parseKeys(bytes), nil
+	return "disk", ParseKeys(bytes, "disk"), nil
 }
 
-func parseKeys(in []byte) (keys []ssh.PublicKey) {
-	var err error
-	var key ssh.PublicKey
-	for {
-		key, _, _, in, err = ssh.ParseAuthorizedKey(in)
-		if err != nil {
-			break
-		}
-		keys = append(keys, key)
-	}
-	return
+// Check checks that the directory can be read.
+func (d Disk) Check(ctx context.Context) error {
+	_, err := fs.Stat(d.FS, ".")
+	return err
 }
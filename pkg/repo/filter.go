@@ -0,0 +1,187 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// spellchecker:words nistp
+
+// Filtered represents a KeyRepository that only returns keys conforming to a Policy.
+// Keys that are removed are recorded in the Report of the context.
+type Filtered struct {
+	Repository KeyRepository
+
+	Policy Policy // policy applied to every request
+}
+
+// GetKeys resolves and returns the keys for the provided username.
+// Keys must conform to both the Policy of f and the policy found in the context (if any).
+func (f *Filtered) GetKeys(context context.Context, username string) (string, []Key, error) {
+	source, keys, err := f.Repository.GetKeys(context, username)
+	if err != nil {
+		return source, keys, err
+	}
+
+	policy := PolicyFromContext(context)
+	if f.Policy.IsZero() && policy.IsZero() {
+		return source, keys, nil
+	}
+
+	report := ReportFromContext(context)
+
+	filtered := make([]Key, 0, len(keys))
+	for _, key := range keys {
+		reason, ok := f.Policy.Check(key)
+		if ok {
+			reason, ok = policy.Check(key)
+		}
+		if !ok {
+			report.AddFiltered(key, username, reason)
+			continue
+		}
+		filtered = append(filtered, key)
+	}
+	return source, filtered, nil
+}
+
+// Policy describes which keys are acceptable.
+// The zero value accepts every key.
+//
+// Key types are given by their short name (e.g. "ed25519", "ecdsa", "rsa", "dsa", "sk-ed25519", "sk-ecdsa")
+// or by their full ssh name (e.g. "ssh-ed25519").
+type Policy struct {
+	Types      []string // if non-empty, only keys of these types are accepted
+	Exclude    []string // keys of these types are rejected
+	MinRSABits int      // rsa keys with fewer bits are rejected
+}
+
+// IsZero checks if this policy accepts every key.
+func (p Policy) IsZero() bool {
+	return len(p.Types) == 0 && len(p.Exclude) == 0 && p.MinRSABits <= 0
+}
+
+// Check checks if the provided key is acceptable.
+// When it is not, returns a human-readable reason why.
+func (p Policy) Check(key Key) (reason string, ok bool) {
+	name, full := keyTypeName(key.PublicKey.Type())
+
+	if len(p.Types) > 0 && !slices.Contains(p.Types, name) && !slices.Contains(p.Types, full) {
+		return fmt.Sprintf("key type %q is not allowed", name), false
+	}
+
+	if slices.Contains(p.Exclude, name) || slices.Contains(p.Exclude, full) {
+		return fmt.Sprintf("key type %q is excluded", name), false
+	}
+
+	if name == "rsa" && p.MinRSABits > 0 {
+		if bits := key.Bits(); bits < p.MinRSABits {
+			return fmt.Sprintf("rsa key has %d bits, but at least %d are required", bits, p.MinRSABits), false
+		}
+	}
+
+	return "", true
+}
+
+// ParsePolicy parses a policy from the query parameters "type", "exclude" and "min-rsa-bits".
+// Types are given as a comma-separated list.
+func ParsePolicy(query url.Values) (p Policy, err error) {
+	if p.Types, err = parseKeyTypes(query["type"]); err != nil {
+		return Policy{}, err
+	}
+	if p.Exclude, err = parseKeyTypes(query["exclude"]); err != nil {
+		return Policy{}, err
+	}
+
+	if bits := query.Get("min-rsa-bits"); bits != "" {
+		p.MinRSABits, err = strconv.Atoi(bits)
+		if err != nil || p.MinRSABits < 0 {
+			return Policy{}, errors.Errorf("invalid value for min-rsa-bits: %q", bits)
+		}
+	}
+
+	return p, nil
+}
+
+// parseKeyTypes parses and validates a list of comma-separated key types
+func parseKeyTypes(values []string) (types []string, err error) {
+	for _, value := range values {
+		for _, tp := range strings.Split(value, ",") {
+			tp = strings.ToLower(strings.TrimSpace(tp))
+			if tp == "" {
+				continue
+			}
+			if tp == "dss" {
+				tp = "dsa"
+			}
+			if !isKnownKeyType(tp) {
+				return nil, errors.Errorf("unknown key type: %q", tp)
+			}
+			types = append(types, tp)
+		}
+	}
+	return types, nil
+}
+
+// keyTypeNames maps the full ssh names of key types to their short names
+var keyTypeNames = map[string]string{
+	"ssh-rsa":                            "rsa",
+	"ssh-dss":                            "dsa",
+	"ssh-ed25519":                        "ed25519",
+	"ecdsa-sha2-nistp256":                "ecdsa",
+	"ecdsa-sha2-nistp384":                "ecdsa",
+	"ecdsa-sha2-nistp521":                "ecdsa",
+	"sk-ssh-ed25519@openssh.com":         "sk-ed25519",
+	"sk-ecdsa-sha2-nistp256@openssh.com": "sk-ecdsa",
+}
+
+// keyTypeName returns the short and full names of the provided ssh key type.
+// Certificates are treated like their underlying key type.
+func keyTypeName(tp string) (name, full string) {
+	full = strings.Replace(tp, "-cert-v01@", "@", 1)
+	full = strings.TrimSuffix(full, "@openssh.com")
+	if strings.HasPrefix(full, "sk-") {
+		full += "@openssh.com"
+	}
+
+	name, ok := keyTypeNames[full]
+	if !ok {
+		name = full
+	}
+	return name, full
+}
+
+// isKnownKeyType checks if tp is a known short or full key type name
+func isKnownKeyType(tp string) bool {
+	if _, ok := keyTypeNames[tp]; ok {
+		return true
+	}
+	for _, name := range keyTypeNames {
+		if name == tp {
+			return true
+		}
+	}
+	return false
+}
+
+// policyKey is the context key used to store a policy
+type policyKey struct{}
+
+// WithPolicy returns a copy of ctx that requests only keys conforming to policy.
+// See Filtered.
+func WithPolicy(ctx context.Context, policy Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, policy)
+}
+
+// PolicyFromContext returns the policy requested by ctx.
+// When no policy has been requested, returns the zero policy.
+func PolicyFromContext(ctx context.Context) Policy {
+	policy, _ := ctx.Value(policyKey{}).(Policy)
+	return policy
+}
@@ -0,0 +1,133 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gregjones/httpcache"
+	"github.com/pkg/errors"
+)
+
+// spellchecker:words gitea forgejo
+
+// GiteaKeys is an object that allows fetching ssh keys for users of a Gitea or Forgejo instance using its API.
+// It implements KeyRepository.
+//
+// The zero value is not ready to use, the caller should instantiate it using NewGiteaKeys.
+type GiteaKeys struct {
+	// BaseURL is the url of the Gitea instance, e.g. "https://codeberg.org/".
+	BaseURL *url.URL
+
+	// Client is the client used to make requests to the Gitea API.
+	Client *http.Client
+}
+
+// GiteaKeysOptions represent options for a GiteaKeys.
+type GiteaKeysOptions struct {
+	// BaseURL is the url of the Gitea instance, e.g. "https://codeberg.org/".
+	BaseURL string
+
+	// Token for Gitea Authentication.
+	// Leave blank for anonymous requests; these might be subject to rate limiting.
+	Token string
+
+	// Timeout is the Timeout for requests to Gitea.
+	// The zero value indicates no timeout.
+	Timeout time.Duration
+
+	// MaxCacheSize is the maximum size of an internally used cache in bytes.
+	// Leave blank to disable.
+	MaxCacheSize int64
+
+	// MaxCacheAge is the maximum age for any value in the cache.
+	// Leave blank to never expire cache entires.
+	MaxCacheAge time.Duration
+
+	// Cache is the cache to use, e.g. a diskcache.Cache.
+	// Leave nil to use an in-memory cache configured using MaxCacheSize and MaxCacheAge.
+	Cache httpcache.Cache
+}
+
+// NewGiteaKeys is a convenience method that instantiates GiteaKeys.
+// It reads options from opts, and returns a new GiteaKeys.
+func NewGiteaKeys(opts GiteaKeysOptions) (*GiteaKeys, error) {
+	var repo GiteaKeys
+
+	// parse the base url, and make sure it is a directory
+	base, err := url.Parse(opts.BaseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid Gitea url")
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	repo.BaseURL = base
+
+	// create a cached http client, using the token from above
+	repo.Client = newCachingClient("gitea", opts.Token, opts.Timeout, newCache(opts.Cache, opts.MaxCacheSize, opts.MaxCacheAge))
+
+	return &repo, nil
+}
+
+// giteaKey is a key returned by the Gitea API
+type giteaKey struct {
+	ID  int64  `json:"id"`
+	Key string `json:"key"`
+}
+
+// GetKeys fetches keys from Gitea for the provided username.
+// May internally cache results, as configured in the Client.
+//
+// If this function determines that a user does not exist, returns UserNotFoundError.
+func (gt GiteaKeys) GetKeys(context context.Context, username string) (string, []Key, error) {
+
+	// this function works in two steps
+	// - fetch the keys via the gitea api
+	// - parse all the keys into Key
+
+	target := gt.BaseURL.JoinPath("api", "v1", "users", username, "keys")
+
+	req, err := http.NewRequestWithContext(context, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := gt.Client.Do(req)
+	if err != nil {
+		return "", nil, wrapUpstreamError(context, err, "GET /users/:username/keys failed")
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil, errUserDoesNotExist
+	default:
+		return "", nil, errors.Errorf("GET /users/:username/keys failed: unexpected status code %d", res.StatusCode)
+	}
+
+	var keys []giteaKey
+	if err := json.NewDecoder(res.Body).Decode(&keys); err != nil {
+		return "", nil, wrapUpstreamError(context, err, "GET /users/:username/keys failed")
+	}
+
+	pks := make([]Key, len(keys))
+	for i, key := range keys {
+		pks[i], err = ParseKey([]byte(key.Key), "gitea")
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	return "gitea", pks, nil
+}
+
+// Check checks that the Gitea API is reachable.
+func (gt GiteaKeys) Check(ctx context.Context) error {
+	return checkUpstream(ctx, gt.Client, gt.BaseURL.JoinPath("api/v1/version").String())
+}
@@ -0,0 +1,131 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// spellchecker:words gitea
+
+const giteaTestKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFtBHyPMbg7hKcechuTx4IQDlJYU/2iH63TMj8ZepZmk alice@laptop"
+
+// newGiteaTestServer starts a stand-in Gitea server.
+// It responds to the keys of "alice" with a single key, to "broken" with an internal server error, and to anyone else with not found.
+// The Authorization header of the last request is stored in authorization.
+func newGiteaTestServer(t *testing.T, authorization *string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorization != nil {
+			*authorization = r.Header.Get("Authorization")
+		}
+
+		switch r.URL.Path {
+		case "/api/v1/users/alice/keys":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[{"id":1,"key":"` + giteaTestKey + `"}]`))
+		case "/api/v1/users/broken/keys":
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newGiteaTestKeys(t *testing.T, server *httptest.Server, token string) *GiteaKeys {
+	t.Helper()
+
+	gt, err := NewGiteaKeys(GiteaKeysOptions{BaseURL: server.URL, Token: token, MaxCacheSize: 1000})
+	if err != nil {
+		t.Fatalf("NewGiteaKeys() error = %v", err)
+	}
+	return gt
+}
+
+func TestGiteaKeys_GetKeys(t *testing.T) {
+	server := newGiteaTestServer(t, nil)
+	gt := newGiteaTestKeys(t, server, "")
+
+	t.Run("existing user", func(t *testing.T) {
+		source, keys, err := gt.GetKeys(context.Background(), "alice")
+		if err != nil {
+			t.Fatalf("GetKeys() error = %v", err)
+		}
+		if source != "gitea" {
+			t.Errorf("GetKeys() source = %q, want %q", source, "gitea")
+		}
+		if len(keys) != 1 {
+			t.Fatalf("GetKeys() returned %d keys, want 1", len(keys))
+		}
+		if keys[0].Comment != "alice@laptop" {
+			t.Errorf("GetKeys() comment = %q, want %q", keys[0].Comment, "alice@laptop")
+		}
+		if keys[0].PublicKey.Type() != "ssh-ed25519" {
+			t.Errorf("GetKeys() type = %q, want %q", keys[0].PublicKey.Type(), "ssh-ed25519")
+		}
+	})
+
+	t.Run("missing user", func(t *testing.T) {
+		_, _, err := gt.GetKeys(context.Background(), "bob")
+		if _, ok := err.(UserNotFoundError); !ok {
+			t.Fatalf("GetKeys() error = %v, want UserNotFoundError", err)
+		}
+
+		// a Combo falls through to the next repository
+		empty := httptest.NewServer(http.NotFoundHandler())
+		t.Cleanup(empty.Close)
+
+		source, _, err := Combo{newGiteaTestKeys(t, empty, ""), gt}.GetKeys(context.Background(), "alice")
+		if err != nil || source != "gitea" {
+			t.Fatalf("Combo.GetKeys() = %q, %v, want %q, nil", source, err, "gitea")
+		}
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		_, _, err := gt.GetKeys(context.Background(), "broken")
+		if err == nil {
+			t.Fatal("GetKeys() error = nil, want an error")
+		}
+		if _, ok := err.(UserNotFoundError); ok {
+			t.Errorf("GetKeys() error = %v, want not a UserNotFoundError", err)
+		}
+		if _, ok := err.(UpstreamTimeoutError); ok {
+			t.Errorf("GetKeys() error = %v, want not an UpstreamTimeoutError", err)
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, _, err := gt.GetKeys(ctx, "alice")
+		var timeout UpstreamTimeoutError
+		if !errors.As(err, &timeout) {
+			t.Fatalf("GetKeys() error = %v, want UpstreamTimeoutError", err)
+		}
+	})
+}
+
+func TestGiteaKeys_Token(t *testing.T) {
+	var authorization string
+	server := newGiteaTestServer(t, &authorization)
+
+	if _, _, err := newGiteaTestKeys(t, server, "secret").GetKeys(context.Background(), "alice"); err != nil {
+		t.Fatalf("GetKeys() error = %v", err)
+	}
+	if want := "Bearer secret"; authorization != want {
+		t.Errorf("Authorization = %q, want %q", authorization, want)
+	}
+
+	if _, _, err := newGiteaTestKeys(t, server, "").GetKeys(context.Background(), "alice"); err != nil {
+		t.Fatalf("GetKeys() error = %v", err)
+	}
+	if authorization != "" {
+		t.Errorf("Authorization = %q, want none", authorization)
+	}
+}
@@ -1,22 +1,20 @@
 package repo
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 
-	"github.com/die-net/lrucache"
 	"github.com/google/go-github/github"
 	"github.com/gregjones/httpcache"
-	"golang.org/x/crypto/ssh"
-	"golang.org/x/oauth2"
 )
 
-// spellchecker:words lrucache gregjones httpcache
-
 // GitHubKeys is an object that allows fetching ssh keys for GitHub Users using the GitHub API.
 // It implements KeyRepository.
 //
@@ -24,6 +22,11 @@ import (
 // See also NewGitHubKeyRepo.
 type GitHubKeys struct {
 	*github.Client
+
+	http *http.Client // the underlying http client
+
+	rateLock sync.RWMutex
+	rate     RateLimit // last known rate limit
 }
 
 // GitHubKeysOptions represent options for a GitHubKeyRepo.
@@ -43,6 +46,19 @@ type GitHubKeysOptions struct {
 	// MaxCacheAge is the maximum age for any value in the cache.
 	// Leave blank to never expire cache entires.
 	MaxCacheAge time.Duration
+
+	// Cache is the cache to use, e.g. a diskcache.Cache.
+	// Leave nil to use an in-memory cache configured using MaxCacheSize and MaxCacheAge.
+	Cache httpcache.Cache
+
+	// BaseURL is the url of the API of a GitHub Enterprise Server, e.g. "https://github.example.com/api/v3/".
+	// Leave blank to use the public GitHub API.
+	BaseURL string
+
+	// UploadURL is the upload url of a GitHub Enterprise Server, e.g. "https://github.example.com/api/uploads/".
+	// Leave blank to use BaseURL.
+	// Ignored unless BaseURL is set.
+	UploadURL string
 }
 
 var errClientReturnedNil = errors.New("github.NewClient returned nil")
@@ -52,38 +68,25 @@ var errClientReturnedNil = errors.New("github.NewClient returned nil")
 func NewGitHubKeys(opts GitHubKeysOptions) (*GitHubKeys, error) {
 	var repo GitHubKeys
 
-	// using a token requires use of a transport.
-	// we create one using oauth2.NewClient().
-	var oauthTransport http.RoundTripper
-	if opts.Token != "" {
-		oauthTransport = oauth2.NewClient(
-			context.Background(),
-			oauth2.StaticTokenSource(
-				&oauth2.Token{AccessToken: opts.Token},
-			),
-		).Transport
-	}
+	// create a cached http client, using the token from above
+	client := newCachingClient("github", opts.Token, opts.Timeout, newCache(opts.Cache, opts.MaxCacheSize, opts.MaxCacheAge))
+	repo.http = client
 
-	// create a new (cached) transport
-	// based on the client above
-	transport := &httpcache.Transport{
-		Transport: oauthTransport,
-		Cache: lrucache.New(
-			opts.MaxCacheSize,
-			int64(opts.MaxCacheAge.Seconds()),
-		),
-		MarkCachedResponses: true,
-	}
+	// initialize the client
+	if opts.BaseURL != "" {
+		uploadURL := opts.UploadURL
+		if uploadURL == "" {
+			uploadURL = opts.BaseURL
+		}
 
-	// finally make an http client with that cache
-	// and the timeout above.
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   opts.Timeout,
+		var err error
+		repo.Client, err = github.NewEnterpriseClient(opts.BaseURL, uploadURL, client)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid GitHub Enterprise url")
+		}
+	} else {
+		repo.Client = github.NewClient(client)
 	}
-
-	// initialize the client
-	repo.Client = github.NewClient(client)
 	if repo.Client == nil {
 		return nil, errClientReturnedNil
 	}
@@ -96,21 +99,46 @@ var errUserDoesNotExist = UserNotFoundError{errors.New("User does not exist")}
 // GetKeys fetches keys from GitHub for the provided username.
 // May internally cache results, as configured in the github.Client.
 //
+// When the context requests UsageSigning, fetches the ssh signing keys of the user instead of the authentication keys.
+//
+// The rate limit of the GitHub API is tracked.
+// Once it is exhausted, only cached responses are used until it resets.
+// If no cached response is available, returns a RateLimitedError.
+//
 // If this function determines that a user does not exist, returns UserNotFoundError.
-func (gr GitHubKeys) GetKeys(context context.Context, username string) (string, []ssh.PublicKey, error) {
+func (gr *GitHubKeys) GetKeys(context context.Context, username string) (string, []Key, error) {
 
 	// this function works in two steps
 	// - fetch the keys via the github api
-	// - parse all the keys into ssh.PublicKey
+	// - parse all the keys into Key
+
+	path := "users/" + url.PathEscape(username) + "/keys"
+	if UsageFromContext(context) == UsageSigning {
+		path = "users/" + url.PathEscape(username) + "/ssh_signing_keys"
+	}
+
+	var keys []*github.Key
+	var res *github.Response
+	var err error
+	if rate := gr.RateLimit(); rate.Exhausted(time.Now()) {
+		keys, err = gr.listCachedKeys(context, path, rate.Reset)
+	} else {
+		keys, res, err = gr.listKeys(context, path)
+		gr.updateRateLimit(res)
 
-	keys, res, err := gr.Users.ListKeys(context, username, &github.ListOptions{})
+		if reset, isRateLimited := gr.rateLimitReset(err); isRateLimited {
+			keys, err = gr.listCachedKeys(context, path, reset)
+		}
+	}
 	if res != nil && res.StatusCode == http.StatusNotFound {
 		return "", nil, errUserDoesNotExist
 	}
-	if err != nil {
-		err = errors.Wrap(err, "Users.ListKeys failed")
+	if _, isRateLimited := err.(RateLimitedError); isRateLimited {
 		return "", nil, err
 	}
+	if err != nil {
+		return "", nil, wrapUpstreamError(context, err, "listing keys failed")
+	}
 
 	// Process all the keys in parallel.
 	// Return the first error (if any)
@@ -118,7 +146,7 @@ func (gr GitHubKeys) GetKeys(context context.Context, username string) (string,
 	var wg sync.WaitGroup
 	wg.Add(len(keys))
 
-	pks := make([]ssh.PublicKey, len(keys))
+	pks := make([]Key, len(keys))
 	errChan := make(chan error, 1)
 
 	for index := range keys {
@@ -131,13 +159,132 @@ func (gr GitHubKeys) GetKeys(context context.Context, username string) (string,
 	return "github", pks, <-errChan // receive will not block because errChan is closed
 }
 
+// listKeys lists the keys found at the provided api path.
+// We make the request manually, as the github.Client does not support listing ssh signing keys.
+func (gr *GitHubKeys) listKeys(ctx context.Context, path string) ([]*github.Key, *github.Response, error) {
+	req, err := gr.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// read the entire body, as responses are only cached once they have been read completely
+	var body bytes.Buffer
+	res, err := gr.Do(ctx, req, &body)
+	if err != nil {
+		return nil, res, err
+	}
+
+	var keys []*github.Key
+	if err := json.Unmarshal(body.Bytes(), &keys); err != nil {
+		return nil, res, err
+	}
+	return keys, res, nil
+}
+
+var errRateLimited = errors.New("GitHub API rate limit exhausted")
+
+// listCachedKeys lists the keys found at the provided api path, using only cached responses.
+// When no cached response exists, returns a RateLimitedError with the provided reset time.
+//
+// This bypasses the github.Client, as it refuses to make any request while rate limited.
+func (gr *GitHubKeys) listCachedKeys(ctx context.Context, path string, reset time.Time) ([]*github.Key, error) {
+	req, err := gr.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Cache-Control", "only-if-cached")
+
+	res, err := gr.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, RateLimitedError{error: errRateLimited, Reset: reset}
+	}
+
+	var keys []*github.Key
+	if err := json.NewDecoder(res.Body).Decode(&keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RateLimit describes the state of a rate limit of an upstream API.
+type RateLimit struct {
+	Limit     int       `json:"limit"`     // the number of requests allowed per period, 0 if unknown
+	Remaining int       `json:"remaining"` // the number of remaining requests in the current period
+	Reset     time.Time `json:"reset"`     // the time the current period ends
+}
+
+// Exhausted checks if the rate limit is known to be exhausted at the provided time.
+func (rl RateLimit) Exhausted(now time.Time) bool {
+	return rl.Limit > 0 && rl.Remaining <= 0 && now.Before(rl.Reset)
+}
+
+// RateLimit returns the last known state of the GitHub API rate limit.
+func (gr *GitHubKeys) RateLimit() RateLimit {
+	gr.rateLock.RLock()
+	defer gr.rateLock.RUnlock()
+
+	return gr.rate
+}
+
+// updateRateLimit updates the rate limit using the provided response
+func (gr *GitHubKeys) updateRateLimit(res *github.Response) {
+	// cached responses contain outdated rate limits
+	if res == nil || res.Response == nil || res.Rate.Limit == 0 || res.Header.Get(httpcache.XFromCache) != "" {
+		return
+	}
+
+	gr.rateLock.Lock()
+	defer gr.rateLock.Unlock()
+
+	gr.rate = RateLimit{
+		Limit:     res.Rate.Limit,
+		Remaining: res.Rate.Remaining,
+		Reset:     res.Rate.Reset.Time,
+	}
+}
+
+// rateLimitReset checks if err indicates that a GitHub rate limit is exhausted, and if so when it resets.
+func (gr *GitHubKeys) rateLimitReset(err error) (reset time.Time, isRateLimited bool) {
+	switch e := err.(type) {
+	case *github.RateLimitError:
+		return e.Rate.Reset.Time, true
+	case *github.AbuseRateLimitError:
+		retryAfter := time.Minute
+		if e.RetryAfter != nil {
+			retryAfter = *e.RetryAfter
+		}
+		return time.Now().Add(retryAfter), true
+	}
+
+	// any other error while the known rate limit is exhausted
+	if rate := gr.RateLimit(); err != nil && rate.Exhausted(time.Now()) {
+		return rate.Reset, true
+	}
+	return time.Time{}, false
+}
+
+// Check checks that the GitHub API is reachable.
+// It uses the rate limit endpoint, which does not count against the rate limit.
+func (gr *GitHubKeys) Check(ctx context.Context) error {
+	target, err := gr.BaseURL.Parse("rate_limit")
+	if err != nil {
+		return err
+	}
+	return checkUpstream(ctx, gr.http, target.String())
+}
+
 // parseKey parses a single GitHub key and writes the result into pks.
 // if an error occurs, it tries to send it to the error channel
-func parseKey(index int, keys []*github.Key, pks []ssh.PublicKey, wg *sync.WaitGroup, errChan chan<- error) {
+func parseKey(index int, keys []*github.Key, pks []Key, wg *sync.WaitGroup, errChan chan<- error) {
 	defer wg.Done()
 
 	var err error
-	if pks[index], _, _, _, err = ssh.ParseAuthorizedKey([]byte(keys[index].GetKey())); err == nil {
+	if pks[index], err = ParseKey([]byte(keys[index].GetKey()), "github"); err == nil {
 		return
 	}
 
@@ -0,0 +1,156 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gregjones/httpcache"
+	"github.com/pkg/errors"
+)
+
+// spellchecker:words gitlab
+
+// GitLabKeys is an object that allows fetching ssh keys for users of a GitLab instance using the GitLab API.
+// It implements KeyRepository.
+//
+// The zero value is not ready to use, the caller should instantiate it using NewGitLabKeys.
+type GitLabKeys struct {
+	// BaseURL is the url of the GitLab instance, e.g. "https://gitlab.com/".
+	BaseURL *url.URL
+
+	// Client is the client used to make requests to the GitLab API.
+	Client *http.Client
+}
+
+// GitLabKeysOptions represent options for a GitLabKeys.
+type GitLabKeysOptions struct {
+	// BaseURL is the url of the GitLab instance, e.g. "https://gitlab.com/".
+	BaseURL string
+
+	// Token for GitLab Authentication.
+	// Leave blank for anonymous requests; these might be subject to rate limiting.
+	Token string
+
+	// Timeout is the Timeout for requests to GitLab.
+	// The zero value indicates no timeout.
+	Timeout time.Duration
+
+	// MaxCacheSize is the maximum size of an internally used cache in bytes.
+	// Leave blank to disable.
+	MaxCacheSize int64
+
+	// MaxCacheAge is the maximum age for any value in the cache.
+	// Leave blank to never expire cache entires.
+	MaxCacheAge time.Duration
+
+	// Cache is the cache to use, e.g. a diskcache.Cache.
+	// Leave nil to use an in-memory cache configured using MaxCacheSize and MaxCacheAge.
+	Cache httpcache.Cache
+}
+
+// NewGitLabKeys is a convenience method that instantiates GitLabKeys.
+// It reads options from opts, and returns a new GitLabKeys.
+func NewGitLabKeys(opts GitLabKeysOptions) (*GitLabKeys, error) {
+	var repo GitLabKeys
+
+	// parse the base url, and make sure it is a directory
+	base, err := url.Parse(opts.BaseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid GitLab url")
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	repo.BaseURL = base
+
+	// create a cached http client, using the token from above
+	repo.Client = newCachingClient("gitlab", opts.Token, opts.Timeout, newCache(opts.Cache, opts.MaxCacheSize, opts.MaxCacheAge))
+
+	return &repo, nil
+}
+
+// gitLabUser is a user returned by the GitLab API
+type gitLabUser struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+// gitLabKey is a key returned by the GitLab API
+type gitLabKey struct {
+	ID  int64  `json:"id"`
+	Key string `json:"key"`
+}
+
+// GetKeys fetches keys from GitLab for the provided username.
+// May internally cache results, as configured in the Client.
+//
+// If this function determines that a user does not exist, returns UserNotFoundError.
+func (gl GitLabKeys) GetKeys(context context.Context, username string) (string, []Key, error) {
+
+	// this function works in three steps
+	// - resolve the username into a user id
+	// - fetch the keys via the gitlab api
+	// - parse all the keys into Key
+
+	var users []gitLabUser
+	if _, err := gl.get(context, "api/v4/users", url.Values{"username": {username}}, &users); err != nil {
+		return "", nil, wrapUpstreamError(context, err, "GET /users failed")
+	}
+	if len(users) == 0 {
+		return "", nil, errUserDoesNotExist
+	}
+
+	var keys []gitLabKey
+	status, err := gl.get(context, "api/v4/users/"+strconv.FormatInt(users[0].ID, 10)+"/keys", nil, &keys)
+	if status == http.StatusNotFound {
+		return "", nil, errUserDoesNotExist
+	}
+	if err != nil {
+		return "", nil, wrapUpstreamError(context, err, "GET /users/:id/keys failed")
+	}
+
+	pks := make([]Key, len(keys))
+	for i, key := range keys {
+		pks[i], err = ParseKey([]byte(key.Key), "gitlab")
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	return "gitlab", pks, nil
+}
+
+// Check checks that the GitLab API is reachable.
+func (gl GitLabKeys) Check(ctx context.Context) error {
+	return checkUpstream(ctx, gl.Client, gl.BaseURL.JoinPath("api/v4/version").String())
+}
+
+// get makes a GET request to the provided path relative to the base url, and decodes the json response into dest.
+// It returns the status code of the response (if any) and an error.
+func (gl GitLabKeys) get(ctx context.Context, path string, query url.Values, dest any) (status int, err error) {
+	target := gl.BaseURL.JoinPath(path)
+	target.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := gl.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, errors.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	return res.StatusCode, json.NewDecoder(res.Body).Decode(dest)
+}
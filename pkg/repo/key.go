@@ -0,0 +1,99 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Key is a single ssh public key returned by a KeyRepository.
+type Key struct {
+	PublicKey ssh.PublicKey
+
+	Comment string   // comment of the key, if any
+	Options []string // authorized_keys options of the key, if any
+	Source  string   // repo-defined identifier of the source the key came from
+	User    string   // the user the key belongs to, only set when keys of several users are merged
+}
+
+// ParseKey parses a single line in authorized_keys format into a key from the given source.
+// Options and comments found in the line are preserved.
+func ParseKey(in []byte, source string) (key Key, err error) {
+	key.PublicKey, key.Comment, key.Options, _, err = ssh.ParseAuthorizedKey(in)
+	if err != nil {
+		return Key{}, err
+	}
+	key.Source = source
+	return key, nil
+}
+
+// ParseKeys parses all keys in an authorized_keys file from the given source.
+// Lines that can not be parsed are skipped.
+func ParseKeys(in []byte, source string) (keys []Key) {
+	for {
+		var key Key
+		var err error
+
+		key.PublicKey, key.Comment, key.Options, in, err = ssh.ParseAuthorizedKey(in)
+		if err != nil {
+			break
+		}
+		key.Source = source
+
+		keys = append(keys, key)
+	}
+	return
+}
+
+// MarshalAuthorizedKey serializes key for inclusion in an OpenSSH authorized_keys file.
+// The return value includes the options and comment of the key (if any) and ends with a newline.
+func (key Key) MarshalAuthorizedKey() []byte {
+	var buffer bytes.Buffer
+
+	if len(key.Options) > 0 {
+		buffer.WriteString(strings.Join(key.Options, ","))
+		buffer.WriteByte(' ')
+	}
+
+	buffer.Write(bytes.TrimSuffix(ssh.MarshalAuthorizedKey(key.PublicKey), []byte("\n")))
+
+	if key.Comment != "" {
+		buffer.WriteByte(' ')
+		buffer.WriteString(key.Comment)
+	}
+
+	buffer.WriteByte('\n')
+	return buffer.Bytes()
+}
+
+// Bits returns the size of the key in bits.
+// If the size can not be determined, returns 0.
+func (key Key) Bits() int {
+	pk := key.PublicKey
+	if cert, ok := pk.(*ssh.Certificate); ok {
+		pk = cert.Key
+	}
+
+	ck, ok := pk.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+
+	switch ck := ck.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return ck.N.BitLen()
+	case *dsa.PublicKey:
+		return ck.P.BitLen()
+	case *ecdsa.PublicKey:
+		return ck.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 8 * ed25519.PublicKeySize
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,53 @@
+package repo
+
+import (
+	"context"
+	"sync"
+)
+
+// MergeKeys resolves the keys of each of the provided users using r, and merges them into a single set of keys.
+// Each returned key is annotated with the user it belongs to.
+// When several users share an identical key, it is only returned once, annotated with the first user it belongs to.
+//
+// Users are resolved concurrently, but the returned keys are in the order of usernames.
+// If resolving any user fails, returns the error of the first such user.
+func MergeKeys(ctx context.Context, r KeyRepository, usernames ...string) ([]Key, error) {
+	results := make([][]Key, len(usernames))
+	errs := make([]error, len(usernames))
+
+	var wg sync.WaitGroup
+	wg.Add(len(usernames))
+	for i, username := range usernames {
+		go func() {
+			defer wg.Done()
+			_, results[i], errs[i] = r.GetKeys(ctx, username)
+		}()
+	}
+	wg.Wait()
+
+	// return the first error (if any)
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// merge the keys, skipping any duplicates
+	seen := make(map[string]struct{})
+
+	var keys []Key
+	for i, result := range results {
+		for _, key := range result {
+			blob := string(key.PublicKey.Marshal())
+			if _, ok := seen[blob]; ok {
+				continue
+			}
+			seen[blob] = struct{}{}
+
+			key.User = usernames[i]
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
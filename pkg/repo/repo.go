@@ -3,8 +3,10 @@ package repo
 
 import (
 	"context"
+	"net"
+	"time"
 
-	"golang.org/x/crypto/ssh"
+	"github.com/pkg/errors"
 )
 
 // KeyRepository is an object that can fetch ssh keys for a given username from a remote source.
@@ -12,11 +14,21 @@ import (
 type KeyRepository interface {
 	// GetKeys resolves and returns the keys for the provided username.
 	// It returns a repo-defined identifier for which source the user came from, along with the set of keys and an error.
+	// Each key retains the comment and options it was stored with (if any).
 	//
 	// When this function determines that a user does not exist, it returns an error of type UserNotFoundError.
 	// When the user is not available for legal reasons, it returns an error of type UserNotAvailableError.
+	// When an upstream call was cancelled or timed out, it returns an error of type UpstreamTimeoutError.
+	// When an upstream rate limit is exhausted, it returns an error of type RateLimitedError.
 	// It may return other error types for undefined errors
-	GetKeys(context context.Context, username string) (source string, keys []ssh.PublicKey, err error)
+	GetKeys(context context.Context, username string) (source string, keys []Key, err error)
+}
+
+// Checker is implemented by a KeyRepository that can check if it is currently able to serve keys.
+type Checker interface {
+	// Check checks if the repository can serve keys, e.g. if its upstream API is reachable.
+	// It returns nil if so, and an error describing the problem otherwise.
+	Check(ctx context.Context) error
 }
 
 // UserNotFoundError indicates that a KeyRepository was unable to find the provided user and is thus unable to return keys for it.
@@ -44,3 +56,51 @@ type UserNotAvailableError struct {
 func (usr UserNotAvailableError) Error() string {
 	return "User not available: " + usr.user
 }
+
+// UpstreamTimeoutError indicates that a KeyRepository was unable to return keys because an upstream call was cancelled or timed out.
+//
+// This type implements github.com/pkg/errors.Causer and go 1.13+ errors.
+type UpstreamTimeoutError struct {
+	error
+}
+
+// Cause returns the error that caused this error.
+func (u UpstreamTimeoutError) Cause() error {
+	return u.error
+}
+
+// Unwrap unwraps this error
+func (u UpstreamTimeoutError) Unwrap() error {
+	return u.error
+}
+
+// RateLimitedError indicates that a KeyRepository was unable to return keys because an upstream rate limit is exhausted.
+//
+// This type implements github.com/pkg/errors.Causer and go 1.13+ errors.
+type RateLimitedError struct {
+	error
+
+	Reset time.Time // the time at which the rate limit resets
+}
+
+// Cause returns the error that caused this error.
+func (r RateLimitedError) Cause() error {
+	return r.error
+}
+
+// Unwrap unwraps this error
+func (r RateLimitedError) Unwrap() error {
+	return r.error
+}
+
+// wrapUpstreamError wraps an error returned from an upstream call made with ctx using message.
+// When the call was cancelled or timed out, returns an UpstreamTimeoutError.
+func wrapUpstreamError(ctx context.Context, err error, message string) error {
+	err = errors.Wrap(err, message)
+
+	var netErr net.Error
+	if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return UpstreamTimeoutError{err}
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package repo
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Report collects details about how a call to GetKeys was resolved.
+// A KeyRepository may record details into the report found in the context passed to GetKeys.
+//
+// A nil Report is valid and discards all details.
+// A Report is safe for concurrent access.
+type Report struct {
+	lock     sync.Mutex
+	filtered []FilteredKey
+	stale    time.Time // time the oldest stale keys were fetched, zero if none
+}
+
+// FilteredKey is a key that was removed from the result of GetKeys.
+type FilteredKey struct {
+	Key    Key
+	User   string // the user the key belongs to
+	Reason string // human-readable reason why the key was removed
+}
+
+// reportKey is the context key used to store a report
+type reportKey struct{}
+
+// WithReport returns a copy of ctx with a new report, along with the report.
+func WithReport(ctx context.Context) (context.Context, *Report) {
+	report := new(Report)
+	return context.WithValue(ctx, reportKey{}, report), report
+}
+
+// ReportFromContext returns the report stored in ctx.
+// When ctx does not contain a report, returns nil.
+func ReportFromContext(ctx context.Context) *Report {
+	report, _ := ctx.Value(reportKey{}).(*Report)
+	return report
+}
+
+// AddFiltered records that key of the given user was removed for the given reason.
+func (report *Report) AddFiltered(key Key, user, reason string) {
+	if report == nil {
+		return
+	}
+
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	report.filtered = append(report.filtered, FilteredKey{Key: key, User: user, Reason: reason})
+}
+
+// Filtered returns all keys that have been removed.
+func (report *Report) Filtered() []FilteredKey {
+	if report == nil {
+		return nil
+	}
+
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	return append([]FilteredKey(nil), report.filtered...)
+}
+
+// MarkStale records that some of the returned keys are stale, because they were fetched at the given time.
+func (report *Report) MarkStale(fetched time.Time) {
+	if report == nil {
+		return
+	}
+
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	if report.stale.IsZero() || fetched.Before(report.stale) {
+		report.stale = fetched
+	}
+}
+
+// Stale checks if any of the returned keys are stale.
+// If so, also returns the time the oldest stale keys were fetched.
+func (report *Report) Stale() (fetched time.Time, stale bool) {
+	if report == nil {
+		return time.Time{}, false
+	}
+
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	return report.stale, !report.stale.IsZero()
+}
@@ -0,0 +1,153 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// spellchecker:words sshsig armor
+
+// This file implements verification of signatures created using 'ssh-keygen -Y sign'.
+// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig.
+
+const (
+	sshsigMagic   = "SSHSIG"
+	sshsigVersion = 1
+
+	sshsigBegin = "-----BEGIN SSH SIGNATURE-----"
+	sshsigEnd   = "-----END SSH SIGNATURE-----"
+)
+
+// sshsigBlob is the binary representation of an ssh signature, following the magic preamble
+type sshsigBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshsigSignedData is the data signed by an ssh signature, following the magic preamble
+type sshsigSignedData struct {
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Hash          []byte
+}
+
+var (
+	errSignatureInvalid   = errors.New("invalid signature")
+	errSignatureNamespace = errors.New("signature has wrong namespace")
+	errSignatureKey       = errors.New("no signature was made using the uploaded key")
+)
+
+// verifySSHSigs verifies that armored contains an ssh signature of message in namespace for every one of keys.
+// Armored may contain several signatures, each surrounded by its own armor.
+func verifySSHSigs(keys []ssh.PublicKey, namespace string, message []byte, armored string) error {
+	signatures := splitSSHSigs(armored)
+	for _, key := range keys {
+		err := errSignatureKey
+		for _, signature := range signatures {
+			sErr := verifySSHSig(key, namespace, message, signature)
+			if sErr == errSignatureKey {
+				continue
+			}
+			if err = sErr; err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return errors.Wrap(err, ssh.FingerprintSHA256(key))
+		}
+	}
+	return nil
+}
+
+// splitSSHSigs splits armored into individual armored signatures.
+func splitSSHSigs(armored string) (signatures []string) {
+	for {
+		start := strings.Index(armored, sshsigBegin)
+		if start == -1 {
+			return
+		}
+		end := strings.Index(armored[start:], sshsigEnd)
+		if end == -1 {
+			return
+		}
+		end += start + len(sshsigEnd)
+
+		signatures = append(signatures, armored[start:end])
+		armored = armored[end:]
+	}
+}
+
+// verifySSHSig verifies that armored is an ssh signature of message in namespace, made using key.
+func verifySSHSig(key ssh.PublicKey, namespace string, message []byte, armored string) error {
+	// remove the armor
+	armored = strings.TrimSpace(armored)
+	body, ok := strings.CutPrefix(armored, sshsigBegin)
+	if !ok {
+		return errSignatureInvalid
+	}
+	body, ok = strings.CutSuffix(body, sshsigEnd)
+	if !ok {
+		return errSignatureInvalid
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return errSignatureInvalid
+	}
+
+	// parse the signature
+	raw, ok = bytes.CutPrefix(raw, []byte(sshsigMagic))
+	if !ok {
+		return errSignatureInvalid
+	}
+	var blob sshsigBlob
+	if err := ssh.Unmarshal(raw, &blob); err != nil || blob.Version != sshsigVersion {
+		return errSignatureInvalid
+	}
+	if blob.Namespace != namespace {
+		return errSignatureNamespace
+	}
+	if !bytes.Equal(blob.PublicKey, key.Marshal()) {
+		return errSignatureKey
+	}
+
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &signature); err != nil {
+		return errSignatureInvalid
+	}
+
+	// hash the message
+	var h hash.Hash
+	switch blob.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return errSignatureInvalid
+	}
+	h.Write(message)
+
+	// and verify the signature
+	signed := append([]byte(sshsigMagic), ssh.Marshal(sshsigSignedData{
+		Namespace:     blob.Namespace,
+		Reserved:      blob.Reserved,
+		HashAlgorithm: blob.HashAlgorithm,
+		Hash:          h.Sum(nil),
+	})...)
+	if err := key.Verify(signed, &signature); err != nil {
+		return errSignatureInvalid
+	}
+	return nil
+}
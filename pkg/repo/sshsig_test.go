@@ -0,0 +1,170 @@
+package repo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// spellchecker:words sshsig armor keygen
+
+// The following keys and signatures were created using:
+//
+//	printf 'challenge' | ssh-keygen -Y sign -f key -n akhttpd
+//
+// The rsa signature uses the default 'rsa-sha2-512' algorithm.
+const (
+	sshsigTestMessage = "challenge"
+
+	sshsigTestEd25519Key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBAGGAFKgTH6F55VfofEvdtJsdgnwKzozwxPqNzhLgkp alice@laptop"
+	sshsigTestRSAKey     = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCMZrOL9k02M/WpxsoWApVgHP+CyPOh7wMzPuIGgpvcehfLyuoLXXj4fQU4afCz0gy9hntQCTPXlIYoEBZuQ6e34PefAyhiCpGoAnpYC5X+sbCVXTB4wyMYB+of/Y38phSq6R00eAePFmwel4qW4dk3GPcghehw4JDwhQ8sM1qAZT/W0KyAW1qlVIL6MbohJWoFXjPVD6TI2ejuZ9+pT1XVLFN6sT4PZg/5TQ3MErX29l4FcfJrq6nTSajAZuIw2DuWvXVZL+7bXj2rQHLtn9E7Q3YghjvPpRvpw8wfvQojMO54Ksmtq35Uv2r0mW8r5H+hfF+3MWXG1/FiutwOWV1Z alice@desktop"
+	sshsigTestOtherKey   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMJailv6sF8kwpxpUp5Stw0hpcexqm966burqWv18Dvb mallory@laptop"
+
+	sshsigTestEd25519Sig = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAgEAYYAUqBMfoXnlV+h8S920mx2C
+fArOjPDE+o3OEuCSkAAAAHYWtodHRwZAAAAAAAAAAGc2hhNTEyAAAAUwAAAAtzc2gtZWQy
+NTUxOQAAAECzc0u1YmQAUu8Or9cHWYhwtTGxI4GhFzBfdVJcVstgnUbeDXYvyjMM6xH4gb
+DG3LOMiDlXZqhJGGJHmX6HjZUF
+-----END SSH SIGNATURE-----
+`
+	sshsigTestRSASig = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAARcAAAAHc3NoLXJzYQAAAAMBAAEAAAEBAIxms4v2TTYz9anGyhYClW
+Ac/4LI86HvAzM+4gaCm9x6F8vK6gtdePh9BThp8LPSDL2Ge1AJM9eUhigQFm5Dp7fg958D
+KGIKkagCelgLlf6xsJVdMHjDIxgH6h/9jfymFKrpHTR4B48WbB6Xipbh2TcY9yCF6HDgkP
+CFDywzWoBlP9bQrIBbWqVUgvoxuiElagVeM9UPpMjZ6O5n36lPVdUsU3qxPg9mD/lNDcwS
+tfb2XgVx8murqdNJqMBm4jDYO5a9dVkv7ttePatAcu2f0TtDdiCGO8+lG+nDzB+9CiMw7n
+gqya2rflS/avSZbyvkf6F8X7cxZcbX8WK63A5ZXVkAAAAHYWtodHRwZAAAAAAAAAAGc2hh
+NTEyAAABFAAAAAxyc2Etc2hhMi01MTIAAAEAezv/L8iuyU5fx+Entn7X0vB4PocERqC+26
+BehorISZE0R9k9vJ8PsdWZY1U2IWrULvKivQy3UDdf5WhCkAMsKTb4+mEQwIIg3kV3Va0R
+vcWQQYbZ/WlfAz0Xc92HPUvDhpLMONKi5ovNK3Hg0IoAY7YlLOg9AjMZX2sUYzUH8c8/8I
+MvPHUS1Ajw3AwBKGhRW8cs6NpyPVIr//Ejay5qkCnfveL4jb+HlWeQYrnNNp6XCEavfqgJ
+y2sFvyQcZBv8eLOksY87rCTIa+Ak+Mq4ErL2EThgsSOzx3eEEu/tVNg6en5smBQfB+tDw/
+ppRF0VGewrVuY7u8wtnqwbo6XqyQ==
+-----END SSH SIGNATURE-----
+`
+	sshsigTestOtherSig = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAgwlqKW/qwXyTCnGlSnlK3DSGlx7
+Gqb3rpu6upa/XwO9sAAAAHYWtodHRwZAAAAAAAAAAGc2hhNTEyAAAAUwAAAAtzc2gtZWQy
+NTUxOQAAAEBzAqKHwktUN1MlpEzWXI3idv9QK9A0e3HNCIM2YeLLokLl9K45/rImRtq2rk
+S0o9XTFtTjYxli+FW2ZOHqwqAO
+-----END SSH SIGNATURE-----
+`
+
+	// created using the same key as sshsigTestEd25519Sig, but with '-n git'
+	sshsigTestGitSig = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAgEAYYAUqBMfoXnlV+h8S920mx2C
+fArOjPDE+o3OEuCSkAAAADZ2l0AAAAAAAAAAZzaGE1MTIAAABTAAAAC3NzaC1lZDI1NTE5
+AAAAQK5cBLx+I7UmXx8kJnDK2DdsY3bE9D6P4Ukl/51nSs3O+YkGJNKFRmRiygM99whIXg
+/UotKETzHRbK7raBgSqQs=
+-----END SSH SIGNATURE-----
+`
+)
+
+// parseSSHSigTestKey parses an authorized_keys line
+func parseSSHSigTestKey(t *testing.T, line string) ssh.PublicKey {
+	t.Helper()
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		t.Fatalf("ParseAuthorizedKey() error = %v", err)
+	}
+	return key
+}
+
+func Test_verifySSHSig(t *testing.T) {
+	ed25519 := parseSSHSigTestKey(t, sshsigTestEd25519Key)
+	rsa := parseSSHSigTestKey(t, sshsigTestRSAKey)
+	other := parseSSHSigTestKey(t, sshsigTestOtherKey)
+
+	// lines of the ed25519 signature
+	lines := strings.Split(strings.TrimSpace(sshsigTestEd25519Sig), "\n")
+
+	tests := []struct {
+		name      string
+		key       ssh.PublicKey
+		namespace string
+		message   string
+		armored   string
+		wantErr   error
+	}{
+		{"ed25519", ed25519, UploadNamespace, sshsigTestMessage, sshsigTestEd25519Sig, nil},
+		{"rsa-sha2-512", rsa, UploadNamespace, sshsigTestMessage, sshsigTestRSASig, nil},
+		{"surrounding whitespace", ed25519, UploadNamespace, sshsigTestMessage, "\n  " + sshsigTestEd25519Sig + "\n\n", nil},
+
+		{"wrong namespace", ed25519, UploadNamespace, sshsigTestMessage, sshsigTestGitSig, errSignatureNamespace},
+		{"different key", other, UploadNamespace, sshsigTestMessage, sshsigTestEd25519Sig, errSignatureKey},
+		{"tampered message", ed25519, UploadNamespace, sshsigTestMessage + "!", sshsigTestEd25519Sig, errSignatureInvalid},
+		{"tampered rsa message", rsa, UploadNamespace, "Challenge", sshsigTestRSASig, errSignatureInvalid},
+
+		{"empty", ed25519, UploadNamespace, sshsigTestMessage, "", errSignatureInvalid},
+		{"missing end", ed25519, UploadNamespace, sshsigTestMessage, strings.Join(lines[:len(lines)-1], "\n"), errSignatureInvalid},
+		{"missing begin", ed25519, UploadNamespace, sshsigTestMessage, strings.Join(lines[1:], "\n"), errSignatureInvalid},
+		{"truncated body", ed25519, UploadNamespace, sshsigTestMessage, strings.Join(append(lines[:len(lines)-2:len(lines)-2], lines[len(lines)-1]), "\n"), errSignatureInvalid},
+		{"malformed base64", ed25519, UploadNamespace, sshsigTestMessage, strings.Replace(sshsigTestEd25519Sig, "U1NIU0lH", "U1NIU0l!", 1), errSignatureInvalid},
+		{"wrong magic", ed25519, UploadNamespace, sshsigTestMessage, strings.Replace(sshsigTestEd25519Sig, "U1NIU0lH", "U1NIU0lI", 1), errSignatureInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySSHSig(tt.key, tt.namespace, []byte(tt.message), tt.armored)
+			if err != tt.wantErr {
+				t.Errorf("verifySSHSig() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_verifySSHSigs(t *testing.T) {
+	ed25519 := parseSSHSigTestKey(t, sshsigTestEd25519Key)
+	rsa := parseSSHSigTestKey(t, sshsigTestRSAKey)
+
+	tests := []struct {
+		name    string
+		keys    []ssh.PublicKey
+		armored string
+		wantErr error
+	}{
+		{"single key", []ssh.PublicKey{ed25519}, sshsigTestEd25519Sig, nil},
+		{"several keys", []ssh.PublicKey{ed25519, rsa}, sshsigTestEd25519Sig + sshsigTestRSASig, nil},
+		{"several keys in any order", []ssh.PublicKey{ed25519, rsa}, sshsigTestRSASig + "\n" + sshsigTestEd25519Sig, nil},
+		{"additional signatures", []ssh.PublicKey{rsa}, sshsigTestOtherSig + sshsigTestEd25519Sig + sshsigTestRSASig, nil},
+
+		{"no signatures", []ssh.PublicKey{ed25519}, "", errSignatureKey},
+		{"one key without signature", []ssh.PublicKey{ed25519, rsa}, sshsigTestEd25519Sig + sshsigTestOtherSig, errSignatureKey},
+		{"one signature with wrong namespace", []ssh.PublicKey{ed25519, rsa}, sshsigTestGitSig + sshsigTestRSASig, errSignatureNamespace},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySSHSigs(tt.keys, UploadNamespace, []byte(sshsigTestMessage), tt.armored)
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("verifySSHSigs() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_verifyUploadKeys(t *testing.T) {
+	keys, err := parseUploadKeys(sshsigTestEd25519Key + "\n" + sshsigTestRSAKey + "\n")
+	if err != nil {
+		t.Fatalf("parseUploadKeys() error = %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("parseUploadKeys() returned %d keys, want 2", len(keys))
+	}
+
+	if err := verifyUploadKeys(keys, sshsigTestMessage, sshsigTestEd25519Sig+sshsigTestRSASig); err != nil {
+		t.Errorf("verifyUploadKeys() error = %v, want nil", err)
+	}
+	if err := verifyUploadKeys(keys, "other challenge", sshsigTestEd25519Sig+sshsigTestRSASig); errors.Cause(err) != errSignatureInvalid {
+		t.Errorf("verifyUploadKeys() error = %v, want %v", err, errSignatureInvalid)
+	}
+
+	err = verifyUploadKeys(keys, sshsigTestMessage, sshsigTestEd25519Sig)
+	if errors.Cause(err) != errSignatureKey {
+		t.Errorf("verifyUploadKeys() error = %v, want %v", err, errSignatureKey)
+	}
+	if rsa := ssh.FingerprintSHA256(keys[1].PublicKey); err == nil || !strings.Contains(err.Error(), rsa) {
+		t.Errorf("verifyUploadKeys() error = %v, want it to mention %s", err, rsa)
+	}
+}
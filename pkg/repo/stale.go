@@ -0,0 +1,144 @@
+package repo
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Stale is a KeyRepository that remembers the keys last successfully returned for every user.
+// When the underlying repository fails, the remembered keys are returned instead and marked as stale in the report of the context.
+//
+// Keys are only remembered for MaxAge, a non-positive MaxAge disables this behavior.
+// At most MaxEntries sets of keys are remembered, after which the least recently used ones are forgotten.
+// Errors of type UserNotFoundError or UserNotAvailableError are always returned as-is, and cause the remembered keys to be forgotten.
+// Stale should only wrap remote repositories, as keys removed from a local repository would otherwise be served again.
+//
+// The zero value is not ready to use, the Repository must be set.
+// Stale is safe for concurrent access.
+type Stale struct {
+	Repository KeyRepository
+
+	MaxAge     time.Duration // maximum age of remembered keys
+	MaxEntries int           // maximum number of remembered sets of keys, non-positive means DefaultStaleMaxEntries
+
+	lock      sync.Mutex
+	entries   map[userKey]*list.Element // elements of order
+	order     list.List                 // of *staleEntry, most recently used first
+	nextSweep int                       // number of entries at which to next remove expired entries
+}
+
+// staleEntry is a set of keys remembered by Stale
+type staleEntry struct {
+	key userKey
+
+	Time   time.Time // time the keys were returned
+	Source string
+	Keys   []Key
+}
+
+// DefaultStaleMaxEntries is the default maximum number of sets of keys remembered by Stale
+const DefaultStaleMaxEntries = 10000
+
+// minStaleSweep is the minimum number of entries before Stale removes expired entries
+const minStaleSweep = 64
+
+// GetKeys resolves and returns the keys for the provided username.
+func (s *Stale) GetKeys(context context.Context, username string) (string, []Key, error) {
+	source, keys, err := s.Repository.GetKeys(context, username)
+	if s.MaxAge <= 0 {
+		return source, keys, err
+	}
+
+	key := userKey{Usage: UsageFromContext(context), Username: username}
+
+	_, isNotFound := err.(UserNotFoundError)
+	_, isNotAvailable := err.(UserNotAvailableError)
+	switch {
+	case err == nil:
+		s.store(&staleEntry{key: key, Time: time.Now(), Source: source, Keys: keys})
+		return source, keys, nil
+	case isNotFound, isNotAvailable:
+		s.forget(key)
+		return source, keys, err
+	}
+
+	entry := s.load(key)
+	if entry == nil {
+		return source, keys, err
+	}
+
+	ReportFromContext(context).MarkStale(entry.Time)
+	return entry.Source, entry.Keys, nil
+}
+
+// load loads the keys remembered for key, provided they have not expired.
+// If there are no such keys, returns nil.
+func (s *Stale) load(key userKey) *staleEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*staleEntry)
+	if time.Since(entry.Time) > s.MaxAge {
+		return nil
+	}
+	s.order.MoveToFront(element)
+	return entry
+}
+
+// store remembers entry, replacing any entry with the same key
+func (s *Stale) store(entry *staleEntry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.entries == nil {
+		s.entries = make(map[userKey]*list.Element)
+	}
+	if element, ok := s.entries[entry.key]; ok {
+		s.order.Remove(element)
+	}
+	s.entries[entry.key] = s.order.PushFront(entry)
+
+	// forget the least recently used entries
+	maxEntries := s.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultStaleMaxEntries
+	}
+	for len(s.entries) > maxEntries {
+		s.remove(s.order.Back())
+	}
+
+	// whenever the number of entries has grown sufficiently, remove all the expired ones.
+	if len(s.entries) < s.nextSweep {
+		return
+	}
+	for _, element := range s.entries {
+		if time.Since(element.Value.(*staleEntry).Time) > s.MaxAge {
+			s.remove(element)
+		}
+	}
+	s.nextSweep = max(2*len(s.entries), minStaleSweep)
+}
+
+// forget forgets the keys remembered for key
+func (s *Stale) forget(key userKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if element, ok := s.entries[key]; ok {
+		s.remove(element)
+	}
+}
+
+// remove removes element from s.
+// The caller must hold the lock.
+func (s *Stale) remove(element *list.Element) {
+	delete(s.entries, element.Value.(*staleEntry).key)
+	s.order.Remove(element)
+}
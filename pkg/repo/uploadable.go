@@ -3,26 +3,40 @@ package repo
 import (
 	"context"
 	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 
-	"golang.org/x/crypto/ssh"
-
 	_ "embed"
 
+	"github.com/tkw1536/akhttpd/pkg/metrics"
 	"github.com/tkw1536/pkglib/lazy"
 	"github.com/tkw1536/pkglib/password"
 	"github.com/tkw1536/pkglib/websocketx"
+	"golang.org/x/crypto/ssh"
 )
 
-// spellchecker:words akhttpd wshandler userkeys
+// spellchecker:words akhttpd wshandler userkeys keygen
 
 // UploadableKeys is an object that allows callers to upload keys to the server temporarily.
+// Before keys are registered, callers have to prove that they own them by signing a challenge, see UploadNamespace.
+//
+// By default, uploaded keys are removed as soon as the upload session ends.
+// When Store is set, callers may instead choose to keep their keys for a limited time.
+// They then receive a token to revoke the keys with before they expire.
+// The number of such persistent uploads is limited, see MaxPersistent and MaxPersistentPerClient.
 type UploadableKeys struct {
 	Prefix  string // Prefix is the prefix for new users
 	counter uint64 // internal counter for usernames
@@ -31,10 +45,37 @@ type UploadableKeys struct {
 
 	WriteSuffix func(w io.Writer) error
 
-	lock sync.RWMutex
-	data map[string][]ssh.PublicKey
+	// Audit, if non-nil, receives an entry whenever keys are registered or released.
+	Audit *slog.Logger
+
+	// ClientIP returns the ip address of the client making a request, for use in the audit log and the limits of persistent uploads.
+	// When nil, uses the RemoteAddr of the request.
+	ClientIP func(r *http.Request) string
+
+	// Store is the path of a file to keep persistent uploads in.
+	// When empty, persistent uploads are disabled.
+	Store string
+
+	// MaxTTL is the maximum time persistent uploads are kept for.
+	// When not positive, there is no maximum.
+	MaxTTL time.Duration
+
+	// MaxPersistent is the maximum number of persistent uploads kept at once.
+	// When not positive, DefaultMaxPersistentUploads is used.
+	MaxPersistent int
 
-	server lazy.Lazy[*websocketx.Server]
+	// MaxPersistentPerClient is the maximum number of persistent uploads kept at once for a single client.
+	// Clients are identified by their ip address, or their /64 network for IPv6.
+	// When not positive, DefaultMaxPersistentUploadsPerClient is used.
+	MaxPersistentPerClient int
+
+	lock    sync.RWMutex
+	data    map[string]upload
+	tokens  map[string]string // usernames of persistent uploads by the hash of their token
+	clients map[string]int    // number of persistent uploads by client
+
+	server     lazy.Lazy[*websocketx.Server]
+	challenges uploadChallenges // challenges issued by the api
 }
 
 var errUserKeysNotConfigured = UserNotFoundError{errors.New("User is not configured in UserKeys")}
@@ -42,44 +83,290 @@ var errUserKeysNotConfigured = UserNotFoundError{errors.New("User is not configu
 // GetKeys fetches keys from GitHub for the provided username.
 //
 // If this function determines that a user does not exist, returns a UserNotFoundError.
-func (uk *UploadableKeys) GetKeys(context context.Context, username string) (string, []ssh.PublicKey, error) {
+func (uk *UploadableKeys) GetKeys(context context.Context, username string) (string, []Key, error) {
 	uk.lock.RLock()
 	defer uk.lock.RUnlock()
 
 	// check if we have the keys
-	keys, ok := uk.data[username]
-	if !ok {
+	upload, ok := uk.data[username]
+	if !ok || upload.Expired(time.Now()) {
 		return "", nil, errUserKeysNotConfigured
 	}
 
-	return "userkeys", keys, nil
+	return "userkeys", upload.Keys, nil
 }
 
 // Register registers a new set of keys from the user.
 // The delete function will delete the user from the cache.
-func (uk *UploadableKeys) Register(keys ...ssh.PublicKey) (username string, cleanup func()) {
+func (uk *UploadableKeys) Register(keys ...Key) (username string, cleanup func()) {
 	uk.lock.Lock()
 	defer uk.lock.Unlock()
 
-	// create a username that does not yet exist
-	for {
-		username = uk.username()
-		if _, ok := uk.data[username]; ok {
-			continue
-		}
-		break
+	username = uk.newUsername()
+	uk.put(username, upload{Keys: keys, Created: time.Now()})
+
+	return username, func() {
+		uk.lock.Lock()
+		defer uk.lock.Unlock()
+
+		uk.remove(username)
+	}
+}
+
+var (
+	errPersistentDisabled = errors.New("persistent uploads are disabled")
+	errInvalidTTL         = errors.New("invalid time to live")
+	errUnknownToken       = errors.New("unknown token")
+	errTooManyUploads     = errors.New("too many persistent uploads")
+	errTooManyFromClient  = errors.New("too many persistent uploads from this client")
+)
+
+const (
+	// DefaultMaxPersistentUploads is the default maximum number of persistent uploads
+	DefaultMaxPersistentUploads = 1000
+
+	// DefaultMaxPersistentUploadsPerClient is the default maximum number of persistent uploads of a single client
+	DefaultMaxPersistentUploadsPerClient = 10
+)
+
+// RegisterPersistent registers a new set of keys from the given client, and keeps them for the given time to live.
+// The keys can be removed before they expire using Revoke, or kept for longer using Extend, with the returned token.
+// When Store is set, the keys are written to it and survive restarts.
+//
+// Client identifies the client making the upload, see uploadClient.
+// When there are too many persistent uploads, in total or from client, returns an error.
+func (uk *UploadableKeys) RegisterPersistent(client string, ttl time.Duration, keys ...Key) (username, token string, expires time.Time, err error) {
+	if !uk.validTTL(ttl) {
+		return "", "", time.Time{}, errInvalidTTL
+	}
+
+	token, err = newUploadToken()
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	uk.lock.Lock()
+	defer uk.lock.Unlock()
+
+	now := time.Now()
+	if err := uk.checkLimits(client, now); err != nil {
+		return "", "", time.Time{}, err
+	}
+	expires = now.Add(ttl)
+
+	username = uk.newUsername()
+	uk.put(username, upload{Keys: keys, Created: now, Expires: expires, Token: hashUploadToken(token), Client: client})
+
+	if err := uk.save(now); err != nil {
+		uk.remove(username)
+		return "", "", time.Time{}, err
+	}
+	return username, token, expires, nil
+}
+
+// checkLimits checks that client may register another persistent upload at the given time.
+// The caller must hold the write lock.
+func (uk *UploadableKeys) checkLimits(client string, now time.Time) error {
+	maxTotal := uk.MaxPersistent
+	if maxTotal <= 0 {
+		maxTotal = DefaultMaxPersistentUploads
+	}
+	maxClient := uk.MaxPersistentPerClient
+	if maxClient <= 0 {
+		maxClient = DefaultMaxPersistentUploadsPerClient
+	}
+
+	// only remove expired uploads when a limit is reached
+	if len(uk.tokens) >= maxTotal || uk.clients[client] >= maxClient {
+		uk.expire(now)
+	}
+
+	switch {
+	case len(uk.tokens) >= maxTotal:
+		return errTooManyUploads
+	case uk.clients[client] >= maxClient:
+		return errTooManyFromClient
+	}
+	return nil
+}
+
+// Revoke removes the persistent upload with the given token before it expires.
+// It returns the username the upload was registered under.
+func (uk *UploadableKeys) Revoke(token string) (username string, err error) {
+	uk.lock.Lock()
+	defer uk.lock.Unlock()
+
+	now := time.Now()
+	name, upload, ok := uk.findToken(token, now)
+	if !ok {
+		return "", errUnknownToken
+	}
+
+	uk.remove(name)
+	if err := uk.save(now); err != nil {
+		uk.put(name, upload)
+		return "", err
+	}
+
+	uk.auditRelease(name, upload.Created, "revoked")
+	return name, nil
+}
+
+// Extend keeps the persistent upload with the given token for the given time to live, starting now.
+// It returns the username the upload was registered under, and the time it now expires.
+func (uk *UploadableKeys) Extend(token string, ttl time.Duration) (username string, expires time.Time, err error) {
+	if !uk.validTTL(ttl) {
+		return "", time.Time{}, errInvalidTTL
 	}
 
+	uk.lock.Lock()
+	defer uk.lock.Unlock()
+
+	now := time.Now()
+	name, upload, ok := uk.findToken(token, now)
+	if !ok {
+		return "", time.Time{}, errUnknownToken
+	}
+
+	extended := upload
+	extended.Expires = now.Add(ttl)
+	uk.put(name, extended)
+	if err := uk.save(now); err != nil {
+		uk.put(name, upload)
+		return "", time.Time{}, err
+	}
+
+	uk.auditExtend(name, extended.Expires)
+	return name, extended.Expires, nil
+}
+
+// findToken finds the persistent upload with the given token that has not expired at the given time.
+// The caller must hold the lock.
+func (uk *UploadableKeys) findToken(token string, now time.Time) (username string, u upload, ok bool) {
+	username, ok = uk.tokens[hashUploadToken(token)]
+	if !ok {
+		return "", upload{}, false
+	}
+	u, ok = uk.data[username]
+	if !ok || !u.Persistent() || u.Expired(now) {
+		return "", upload{}, false
+	}
+	return username, u, true
+}
+
+// put stores u under name, replacing any previous upload.
+// The caller must hold the write lock.
+func (uk *UploadableKeys) put(name string, u upload) {
+	uk.remove(name)
+
 	if uk.data == nil {
-		uk.data = make(map[string][]ssh.PublicKey)
+		uk.data = make(map[string]upload)
 	}
-	uk.data[username] = keys
+	uk.data[name] = u
 
-	return username, func() {
-		uk.lock.Lock()
-		defer uk.lock.Unlock()
+	if !u.Persistent() {
+		return
+	}
+	if uk.tokens == nil {
+		uk.tokens = make(map[string]string)
+	}
+	uk.tokens[u.Token] = name
+	if uk.clients == nil {
+		uk.clients = make(map[string]int)
+	}
+	uk.clients[u.Client]++
+}
 
-		delete(uk.data, username)
+// remove removes the upload stored under name, if any.
+// The caller must hold the write lock.
+func (uk *UploadableKeys) remove(name string) {
+	u, ok := uk.data[name]
+	if !ok {
+		return
+	}
+	delete(uk.data, name)
+
+	if !u.Persistent() {
+		return
+	}
+	delete(uk.tokens, u.Token)
+	if uk.clients[u.Client]--; uk.clients[u.Client] <= 0 {
+		delete(uk.clients, u.Client)
+	}
+}
+
+// ttlSeconds returns a time to live of the given number of seconds
+func ttlSeconds(seconds int64) (time.Duration, error) {
+	if seconds <= 0 || seconds > int64(math.MaxInt64/time.Second) {
+		return 0, errInvalidTTL
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// validTTL checks if ttl is a valid time to live for persistent uploads
+func (uk *UploadableKeys) validTTL(ttl time.Duration) bool {
+	return ttl > 0 && (uk.MaxTTL <= 0 || ttl <= uk.MaxTTL)
+}
+
+// Load loads persistent uploads from Store, replacing any previously loaded persistent uploads.
+// It should be called once before serving any requests.
+func (uk *UploadableKeys) Load() error {
+	if uk.Store == "" {
+		return nil
+	}
+
+	uploads, err := readUploadStore(uk.Store)
+	if err != nil {
+		return err
+	}
+
+	uk.lock.Lock()
+	defer uk.lock.Unlock()
+
+	for name, upload := range uk.data {
+		if upload.Persistent() {
+			uk.remove(name)
+		}
+	}
+	for name, upload := range uploads {
+		uk.put(name, upload)
+	}
+
+	return uk.save(time.Now())
+}
+
+// save removes all expired uploads and writes the remaining persistent uploads to Store, if set.
+// The caller must hold the write lock.
+func (uk *UploadableKeys) save(now time.Time) error {
+	uk.expire(now)
+	if uk.Store == "" {
+		return nil
+	}
+	return writeUploadStore(uk.Store, uk.data)
+}
+
+// expire removes all uploads that have expired at the given time.
+// The caller must hold the write lock.
+func (uk *UploadableKeys) expire(now time.Time) {
+	for name, upload := range uk.data {
+		if upload.Expired(now) {
+			uk.remove(name)
+			uk.auditRelease(name, upload.Created, "expired")
+		}
+	}
+}
+
+// newUsername generates a username that is not yet registered.
+// The caller must hold the write lock.
+func (uk *UploadableKeys) newUsername() (username string) {
+	if uk.data == nil {
+		uk.data = make(map[string]upload)
+	}
+	for {
+		username = uk.username()
+		if _, ok := uk.data[username]; !ok {
+			return username
+		}
 	}
 }
 
@@ -93,16 +380,62 @@ func (uk *UploadableKeys) username() string {
 }
 
 func (uk *UploadableKeys) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// requests to modify an upload are authenticated using its token
+	if strings.HasSuffix(r.URL.Path, "/api") && (r.Method == http.MethodPut || r.Method == http.MethodDelete) {
+		uk.handleAPIToken(w, r)
+		return
+	}
+
 	if !uk.auth(w, r) {
 		return
 	}
 
-	uk.server.Get(func() *websocketx.Server {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/revoke"):
+		uk.handleRevoke(w, r)
+		return
+	case strings.HasSuffix(r.URL.Path, "/api"):
+		uk.handleAPI(w, r)
+		return
+	}
+
+	uk.websocketServer().ServeHTTP(w, r)
+}
+
+// handleRevoke revokes the persistent upload with the token in the 'token' form value
+func (uk *UploadableKeys) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Add("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, err := uk.Revoke(r.PostFormValue("token"))
+	switch {
+	case err == errUnknownToken:
+		http.Error(w, "Unknown token", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Revoked\n"))
+	}
+}
+
+// Shutdown gracefully closes all upload sessions, and waits for them to end.
+// Afterwards, no new upload sessions are accepted.
+func (uk *UploadableKeys) Shutdown() {
+	uk.websocketServer().ShutdownWith(websocketx.CloseFrame{})
+}
+
+// websocketServer returns the server handling upload sessions
+func (uk *UploadableKeys) websocketServer() *websocketx.Server {
+	return uk.server.Get(func() *websocketx.Server {
 		return &websocketx.Server{
 			Handler:  uk.handleWS,
 			Fallback: http.HandlerFunc(uk.handleHTTP),
 		}
-	}).ServeHTTP(w, r)
+	})
 }
 
 //go:embed uploadable.min.html
@@ -130,30 +463,273 @@ func (uk *UploadableKeys) auth(w http.ResponseWriter, r *http.Request) bool {
 	return false
 }
 
+var uploadSessions = metrics.NewGauge(
+	"akhttpd_upload_sessions",
+	"Number of currently active upload sessions.",
+)
+
+// UploadNamespace is the namespace uploaded keys must sign challenges in, see 'ssh-keygen -Y sign'.
+const UploadNamespace = "akhttpd"
+
+// uploadChallengeTimeout is the maximum time a client may take to sign a challenge
+const uploadChallengeTimeout = 5 * time.Minute
+
+// maxUploadKeys is the maximum number of keys in a single upload
+const maxUploadKeys = 16
+
+// uploadMessage is a json message exchanged during an upload session.
+//
+// An upload session proceeds as follows:
+// The client sends the keys to upload, in authorized_keys format.
+// The server responds with a random challenge and the namespace to sign it in.
+// If persistent uploads are enabled, it also includes the maximum time to live in seconds (or -1 if there is no maximum).
+// The client sends signatures of the challenge for every key, as created by 'ssh-keygen -Y sign', and an optional time to live in seconds.
+// The server verifies the signatures, registers the keys, and responds with the username.
+//
+// Without a time to live, the keys remain registered until the connection is closed.
+// With a time to live, the server also responds with the time the keys expire and a token to revoke them with, and closes the connection.
+// Whenever something goes wrong, the server instead sends an error and closes the connection.
+type uploadMessage struct {
+	Key       string `json:"key,omitempty"`       // sent by the client
+	Challenge string `json:"challenge,omitempty"` // sent by the server
+	Namespace string `json:"namespace,omitempty"` // sent by the server
+	MaxTTL    int64  `json:"max_ttl,omitempty"`   // sent by the server
+	Signature string `json:"signature,omitempty"` // sent by the client
+	TTL       int64  `json:"ttl,omitempty"`       // sent by the client
+	User      string `json:"user,omitempty"`      // sent by the server
+	Expires   string `json:"expires,omitempty"`   // sent by the server
+	Token     string `json:"token,omitempty"`     // sent by the server
+	Error     string `json:"error,omitempty"`     // sent by the server
+}
+
 func (uk *UploadableKeys) handleWS(conn *websocketx.Connection) {
-	key, ok := <-conn.Read()
-	if !ok {
+	// read the public keys from the connection!
+	var message uploadMessage
+	if !readUploadMessage(conn, &message) {
+		return
+	}
+	keys, err := parseUploadKeys(message.Key)
+	if err != nil {
+		writeUploadMessage(conn, uploadMessage{Error: err.Error()})
 		return
 	}
 
-	// read a private key from the connection!
-	pk, _, _, _, err := ssh.ParseAuthorizedKey(key.Body)
+	// ask the client to prove that they own the keys
+	challenge, err := newUploadChallenge()
 	if err != nil {
+		writeUploadMessage(conn, uploadMessage{Error: "failed to create challenge"})
+		return
+	}
+	var maxTTL int64
+	if uk.Store != "" {
+		maxTTL = uk.maxTTLSeconds()
+	}
+	writeUploadMessage(conn, uploadMessage{Challenge: challenge, Namespace: UploadNamespace, MaxTTL: maxTTL})
+
+	timeout := time.AfterFunc(uploadChallengeTimeout, func() { conn.Close() })
+	ok := readUploadMessage(conn, &message)
+	timeout.Stop()
+	if !ok {
+		return
+	}
+	if err := verifyUploadKeys(keys, challenge, message.Signature); err != nil {
+		writeUploadMessage(conn, uploadMessage{Error: err.Error()})
+		return
+	}
+
+	// register the keys persistently
+	if message.TTL != 0 {
+		if uk.Store == "" {
+			writeUploadMessage(conn, uploadMessage{Error: errPersistentDisabled.Error()})
+			return
+		}
+
+		ttl, err := ttlSeconds(message.TTL)
+		if err != nil {
+			writeUploadMessage(conn, uploadMessage{Error: err.Error()})
+			return
+		}
+
+		username, token, expires, err := uk.RegisterPersistent(uk.uploadClient(conn.Request()), ttl, keys...)
+		if err != nil {
+			writeUploadMessage(conn, uploadMessage{Error: err.Error()})
+			return
+		}
+		uk.auditRegister(conn.Request(), username, expires, keys...)
+
+		writeUploadMessage(conn, uploadMessage{User: username, Expires: expires.Format(time.RFC3339), Token: token})
 		return
 	}
 
-	// register the key
-	username, cleanup := uk.Register(pk)
+	// register the keys
+	username, cleanup := uk.Register(keys...)
 	defer cleanup()
 
+	uk.auditRegister(conn.Request(), username, time.Time{}, keys...)
+	defer uk.auditRelease(username, time.Now(), "closed")
+
+	uploadSessions.Add(1)
+	defer uploadSessions.Add(-1)
+
 	// Write the username back
-	conn.WriteText(username)
+	writeUploadMessage(conn, uploadMessage{User: username})
 
 	// and wait for the connection to be closed
 	// by the client
 	<-conn.Context().Done()
 }
 
+var errUploadKeyCount = fmt.Errorf("expected between 1 and %d public keys", maxUploadKeys)
+
+// parseUploadKeys parses the keys of an upload in authorized_keys format.
+// Options of the keys are discarded, see parseUploadKey.
+func parseUploadKeys(authorizedKeys string) ([]Key, error) {
+	keys := ParseKeys([]byte(authorizedKeys), "userkeys")
+	if len(keys) == 0 || len(keys) > maxUploadKeys {
+		return nil, errUploadKeyCount
+	}
+	for i := range keys {
+		keys[i].Options = nil
+	}
+	return keys, nil
+}
+
+// parseUploadKey parses a single uploaded key in authorized_keys format.
+// Options of the key are discarded, as only the options allowed by the formatters may be served.
+func parseUploadKey(line string) (Key, error) {
+	key, err := ParseKey([]byte(line), "userkeys")
+	key.Options = nil
+	return key, err
+}
+
+// verifyUploadKeys verifies that signatures contains a signature of challenge for every one of keys
+func verifyUploadKeys(keys []Key, challenge, signatures string) error {
+	publicKeys := make([]ssh.PublicKey, len(keys))
+	for i, key := range keys {
+		publicKeys[i] = key.PublicKey
+	}
+	return verifySSHSigs(publicKeys, UploadNamespace, []byte(challenge), signatures)
+}
+
+// maxTTLSeconds returns the maximum time to live for persistent uploads in seconds, or -1 if there is no maximum.
+func (uk *UploadableKeys) maxTTLSeconds() int64 {
+	if uk.MaxTTL <= 0 {
+		return -1
+	}
+	return int64(uk.MaxTTL / time.Second)
+}
+
+// newUploadChallenge generates a new random challenge
+func newUploadChallenge() (string, error) {
+	var challenge [32]byte
+	if _, err := rand.Read(challenge[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(challenge[:]), nil
+}
+
+// readUploadMessage reads the next message from conn into message.
+// When the connection is closed, or the message is invalid, returns false.
+func readUploadMessage(conn *websocketx.Connection, message *uploadMessage) bool {
+	raw, ok := <-conn.Read()
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(raw.Body, message); err != nil {
+		writeUploadMessage(conn, uploadMessage{Error: "invalid message"})
+		return false
+	}
+	return true
+}
+
+// writeUploadMessage writes message to conn
+func writeUploadMessage(conn *websocketx.Connection, message uploadMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return conn.WriteText(string(data))
+}
+
+// clientIP returns the ip address of the client making r
+func (uk *UploadableKeys) clientIP(r *http.Request) string {
+	if uk.ClientIP != nil {
+		return uk.ClientIP(r)
+	}
+	return r.RemoteAddr
+}
+
+// uploadClient identifies the client making r for the limits of persistent uploads.
+// This is the ip address of the client, or its /64 network for IPv6 addresses.
+func (uk *UploadableKeys) uploadClient(r *http.Request) string {
+	ip := uk.clientIP(r)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String()
+	}
+	return addr.String()
+}
+
+// auditRegister records that keys were registered for username in the audit log.
+// For persistent uploads, expires is the time the keys expire.
+func (uk *UploadableKeys) auditRegister(r *http.Request, username string, expires time.Time, keys ...Key) {
+	if uk.Audit == nil {
+		return
+	}
+
+	clientIP := uk.clientIP(r)
+
+	fingerprints := make([]string, len(keys))
+	for i, key := range keys {
+		fingerprints[i] = ssh.FingerprintSHA256(key.PublicKey)
+	}
+
+	attrs := []slog.Attr{
+		slog.String("user", username),
+		slog.Any("keys", fingerprints),
+		slog.String("client_ip", clientIP),
+	}
+	if !expires.IsZero() {
+		attrs = append(attrs, slog.Time("expires", expires))
+	}
+	uk.Audit.LogAttrs(r.Context(), slog.LevelInfo, "register", attrs...)
+}
+
+// auditExtend records that the keys registered for username were extended to expire at the given time in the audit log
+func (uk *UploadableKeys) auditExtend(username string, expires time.Time) {
+	if uk.Audit == nil {
+		return
+	}
+
+	uk.Audit.LogAttrs(context.Background(), slog.LevelInfo, "extend",
+		slog.String("user", username),
+		slog.Time("expires", expires),
+	)
+}
+
+// auditRelease records that the keys registered for username at the given time were released in the audit log.
+// Reason is one of "closed", "revoked" or "expired".
+func (uk *UploadableKeys) auditRelease(username string, registered time.Time, reason string) {
+	if uk.Audit == nil {
+		return
+	}
+
+	uk.Audit.LogAttrs(context.Background(), slog.LevelInfo, "release",
+		slog.String("user", username),
+		slog.Duration("duration", time.Since(registered)),
+		slog.String("reason", reason),
+	)
+}
+
 func (uk *UploadableKeys) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "text/html")
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,97 @@
+package repo
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseUploadKeys(t *testing.T) {
+	keys, err := parseUploadKeys(`command="/bin/sh",no-pty ` + sshsigTestEd25519Key + "\n" + sshsigTestRSAKey + "\n")
+	if err != nil {
+		t.Fatalf("parseUploadKeys() error = %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("parseUploadKeys() returned %d keys, want 2", len(keys))
+	}
+	for _, key := range keys {
+		if key.Options != nil {
+			t.Errorf("parseUploadKeys() options = %v, want none", key.Options)
+		}
+	}
+	if keys[0].Comment != "alice@laptop" {
+		t.Errorf("parseUploadKeys() comment = %q, want %q", keys[0].Comment, "alice@laptop")
+	}
+
+	if _, err := parseUploadKeys(""); err != errUploadKeyCount {
+		t.Errorf("parseUploadKeys() error = %v, want %v", err, errUploadKeyCount)
+	}
+	if _, err := parseUploadKeys(strings.Repeat(sshsigTestEd25519Key+"\n", maxUploadKeys+1)); err != errUploadKeyCount {
+		t.Errorf("parseUploadKeys() error = %v, want %v", err, errUploadKeyCount)
+	}
+}
+
+func TestUploadableKeys_RegisterPersistent(t *testing.T) {
+	uk := &UploadableKeys{MaxPersistent: 3, MaxPersistentPerClient: 2}
+	keys, err := parseUploadKeys(sshsigTestEd25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, token, _, err := uk.RegisterPersistent("192.0.2.1", time.Hour, keys...)
+	if err != nil {
+		t.Fatalf("RegisterPersistent() error = %v", err)
+	}
+	if _, _, _, err := uk.RegisterPersistent("192.0.2.1", time.Hour, keys...); err != nil {
+		t.Fatalf("RegisterPersistent() error = %v", err)
+	}
+	if _, _, _, err := uk.RegisterPersistent("192.0.2.1", time.Hour, keys...); err != errTooManyFromClient {
+		t.Fatalf("RegisterPersistent() error = %v, want %v", err, errTooManyFromClient)
+	}
+	if _, _, _, err := uk.RegisterPersistent("192.0.2.2", time.Hour, keys...); err != nil {
+		t.Fatalf("RegisterPersistent() error = %v", err)
+	}
+	if _, _, _, err := uk.RegisterPersistent("192.0.2.3", time.Hour, keys...); err != errTooManyUploads {
+		t.Fatalf("RegisterPersistent() error = %v, want %v", err, errTooManyUploads)
+	}
+
+	// uploads that are not persistent do not count
+	_, cleanup := uk.Register(keys...)
+	defer cleanup()
+
+	// revoking an upload frees up space
+	if _, err := uk.Revoke(token); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if _, err := uk.Revoke(token); err != errUnknownToken {
+		t.Fatalf("Revoke() error = %v, want %v", err, errUnknownToken)
+	}
+	if _, _, _, err := uk.RegisterPersistent("192.0.2.1", time.Hour, keys...); err != nil {
+		t.Fatalf("RegisterPersistent() error = %v", err)
+	}
+	if len(uk.tokens) != 3 || uk.clients["192.0.2.1"] != 2 || uk.clients["192.0.2.2"] != 1 {
+		t.Errorf("tokens = %d, clients = %v", len(uk.tokens), uk.clients)
+	}
+}
+
+func TestUploadableKeys_uploadClient(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "2001:db8::/64"},
+		{"[2001:db8::ffff:1]:1234", "2001:db8::/64"},
+		{"[::ffff:192.0.2.1]:1234", "192.0.2.1"},
+		{"invalid", "invalid"},
+	}
+	var uk UploadableKeys
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if got := uk.uploadClient(r); got != tt.want {
+			t.Errorf("uploadClient(%q) = %q, want %q", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package repo
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// spellchecker:words multipart hmac
+
+// This file implements a plain http api for uploads, for clients that can not keep a websocket open.
+// See UploadableKeys.handleAPI.
+
+// defaultAPITTL is the time to live of uploads made using the api, unless requested otherwise
+const defaultAPITTL = time.Hour
+
+// maxAPIRequestSize is the maximum size of a request body accepted by the api
+const maxAPIRequestSize = 1 << 20
+
+// uploadChallenges issues and checks the challenges of the api.
+// Each challenge can only be used once, and only until it expires.
+//
+// Challenges are not stored when they are issued.
+// Instead, each challenge consists of the time it expires and a random nonce, authenticated using a secret only known to the server.
+// Only the nonces of used challenges are remembered, and only until the challenge expires.
+//
+// The zero value is ready to use.
+// uploadChallenges is safe for concurrent access.
+type uploadChallenges struct {
+	lock      sync.Mutex
+	secret    []byte               // secret to authenticate challenges with, created on first use
+	used      map[string]time.Time // nonces of used challenges and the time they expire
+	nextSweep int                  // number of used nonces at which to next remove expired ones
+}
+
+const (
+	uploadChallengeNonceSize = 16
+	uploadChallengeMACSize   = sha256.Size
+	uploadChallengeSize      = 8 + uploadChallengeNonceSize + uploadChallengeMACSize
+)
+
+// minChallengeSweep is the minimum number of used nonces before uploadChallenges removes expired ones
+const minChallengeSweep = 64
+
+// Issue issues a new challenge, valid for uploadChallengeTimeout
+func (uc *uploadChallenges) Issue() (string, error) {
+	secret, err := uc.getSecret()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := make([]byte, 8+uploadChallengeNonceSize, uploadChallengeSize)
+	binary.BigEndian.PutUint64(challenge, uint64(time.Now().Add(uploadChallengeTimeout).Unix()))
+	if _, err := rand.Read(challenge[8:]); err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	return hex.EncodeToString(mac.Sum(challenge)), nil
+}
+
+// Use checks if challenge was issued and has not expired.
+// Afterwards, the challenge can not be used again.
+func (uc *uploadChallenges) Use(challenge string) bool {
+	raw, err := hex.DecodeString(challenge)
+	if err != nil || len(raw) != uploadChallengeSize {
+		return false
+	}
+
+	secret, err := uc.getSecret()
+	if err != nil {
+		return false
+	}
+
+	// check that the challenge was issued by us, and has not expired
+	data, sum := raw[:8+uploadChallengeNonceSize], raw[8+uploadChallengeNonceSize:]
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return false
+	}
+
+	now := time.Now()
+	expires := time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
+	if now.After(expires) {
+		return false
+	}
+
+	// check that the challenge has not been used before
+	nonce := string(data[8:])
+
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+
+	if uc.used == nil {
+		uc.used = make(map[string]time.Time)
+	}
+	if _, ok := uc.used[nonce]; ok {
+		return false
+	}
+	uc.used[nonce] = expires
+
+	// whenever the number of used nonces has grown sufficiently, remove all the expired ones.
+	if len(uc.used) >= uc.nextSweep {
+		for nonce, expires := range uc.used {
+			if now.After(expires) {
+				delete(uc.used, nonce)
+			}
+		}
+		uc.nextSweep = max(2*len(uc.used), minChallengeSweep)
+	}
+	return true
+}
+
+// getSecret returns the secret to authenticate challenges with, creating it if needed
+func (uc *uploadChallenges) getSecret() ([]byte, error) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+
+	if uc.secret != nil {
+		return uc.secret, nil
+	}
+
+	secret := make([]byte, sha256.BlockSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	uc.secret = secret
+	return uc.secret, nil
+}
+
+var errUnknownChallenge = errors.New("unknown or expired challenge")
+
+// handleAPI handles requests to the upload api that do not require a token.
+//
+//	GET .../api
+//
+// Returns a new challenge, the namespace to sign it in and the maximum time to live in seconds (-1 if there is no maximum) as json.
+// The challenge is valid for 5 minutes, and can only be used once.
+//
+//	POST .../api
+//
+// Uploads keys, using the form values 'keys' (in authorized_keys format), 'challenge', 'signature' and 'ttl' (in seconds, by default one hour).
+// See uploadMessage for how to create the signature.
+// Returns HTTP 201 with the username, the time the keys expire and a token to modify the upload with as json.
+// Uploads made using the api always expire, and remain until then even without an open connection.
+// They count towards the limits of persistent uploads, beyond which HTTP 429 is returned.
+func (uk *UploadableKeys) handleAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		challenge, err := uk.challenges.Issue()
+		if err != nil {
+			writeAPIResponse(w, http.StatusInternalServerError, uploadMessage{Error: "failed to issue challenge"})
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, uploadMessage{Challenge: challenge, Namespace: UploadNamespace, MaxTTL: uk.maxTTLSeconds()})
+	case http.MethodPost:
+		uk.handleAPICreate(w, r)
+	default:
+		w.Header().Add("Allow", "GET, POST, PUT, DELETE")
+		writeAPIResponse(w, http.StatusMethodNotAllowed, uploadMessage{Error: "method not allowed"})
+	}
+}
+
+// handleAPICreate handles a request to create a new upload using the api
+func (uk *UploadableKeys) handleAPICreate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIRequestSize)
+
+	keys, err := parseUploadKeys(apiFormValue(r, "keys"))
+	if err != nil {
+		writeAPIResponse(w, http.StatusBadRequest, uploadMessage{Error: err.Error()})
+		return
+	}
+
+	ttl, err := parseAPITTL(apiFormValue(r, "ttl"))
+	if err != nil {
+		writeAPIResponse(w, http.StatusBadRequest, uploadMessage{Error: err.Error()})
+		return
+	}
+
+	challenge := apiFormValue(r, "challenge")
+	if !uk.challenges.Use(challenge) {
+		writeAPIResponse(w, http.StatusForbidden, uploadMessage{Error: errUnknownChallenge.Error()})
+		return
+	}
+	if err := verifyUploadKeys(keys, challenge, apiFormValue(r, "signature")); err != nil {
+		writeAPIResponse(w, http.StatusForbidden, uploadMessage{Error: err.Error()})
+		return
+	}
+
+	username, token, expires, err := uk.RegisterPersistent(uk.uploadClient(r), ttl, keys...)
+	switch {
+	case err == errInvalidTTL:
+		writeAPIResponse(w, http.StatusBadRequest, uploadMessage{Error: err.Error()})
+		return
+	case err == errTooManyUploads || err == errTooManyFromClient:
+		writeAPIResponse(w, http.StatusTooManyRequests, uploadMessage{Error: err.Error()})
+		return
+	case err != nil:
+		writeAPIResponse(w, http.StatusInternalServerError, uploadMessage{Error: "failed to register keys"})
+		return
+	}
+	uk.auditRegister(r, username, expires, keys...)
+
+	writeAPIResponse(w, http.StatusCreated, uploadMessage{User: username, Expires: expires.Format(time.RFC3339), Token: token})
+}
+
+// handleAPIToken handles requests to the upload api that require a token.
+// The token must be passed using an 'Authorization: Bearer' header.
+//
+//	PUT .../api
+//
+// Extends the upload to expire after the time to live in the 'ttl' form value (in seconds, by default one hour), starting now.
+// Returns the username and the time the keys now expire as json.
+//
+//	DELETE .../api
+//
+// Revokes the upload, and returns its username as json.
+func (uk *UploadableKeys) handleAPIToken(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIResponse(w, http.StatusUnauthorized, uploadMessage{Error: "missing token"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIRequestSize)
+
+	var (
+		username string
+		expires  time.Time
+		err      error
+	)
+	switch r.Method {
+	case http.MethodPut:
+		var ttl time.Duration
+		ttl, err = parseAPITTL(apiFormValue(r, "ttl"))
+		if err == nil {
+			username, expires, err = uk.Extend(token, ttl)
+		}
+	case http.MethodDelete:
+		username, err = uk.Revoke(token)
+	}
+
+	switch {
+	case err == errUnknownToken:
+		writeAPIResponse(w, http.StatusNotFound, uploadMessage{Error: err.Error()})
+	case err == errInvalidTTL:
+		writeAPIResponse(w, http.StatusBadRequest, uploadMessage{Error: err.Error()})
+	case err != nil:
+		writeAPIResponse(w, http.StatusInternalServerError, uploadMessage{Error: "failed to update keys"})
+	case expires.IsZero():
+		writeAPIResponse(w, http.StatusOK, uploadMessage{User: username})
+	default:
+		writeAPIResponse(w, http.StatusOK, uploadMessage{User: username, Expires: expires.Format(time.RFC3339)})
+	}
+}
+
+// parseAPITTL parses a time to live in seconds.
+// An empty value results in defaultAPITTL.
+func parseAPITTL(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultAPITTL, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errInvalidTTL
+	}
+	return ttlSeconds(seconds)
+}
+
+// apiFormValue returns the form value with the given name.
+// Unlike r.FormValue, it also accepts values uploaded as files in multipart forms, e.g. using 'curl -F keys=@file'.
+func apiFormValue(r *http.Request, name string) string {
+	if value := r.FormValue(name); value != "" || r.MultipartForm == nil {
+		return value
+	}
+
+	files := r.MultipartForm.File[name]
+	if len(files) == 0 {
+		return ""
+	}
+	file, err := files[0].Open()
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	value, err := io.ReadAll(file)
+	if err != nil {
+		return ""
+	}
+	return string(value)
+}
+
+// writeAPIResponse writes message as a json response with the given status code
+func writeAPIResponse(w http.ResponseWriter, code int, message uploadMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(message)
+}
@@ -0,0 +1,47 @@
+package repo
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_uploadChallenges(t *testing.T) {
+	var uc, other uploadChallenges
+
+	challenge, err := uc.Issue()
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+
+	// tamper with the last byte of the challenge
+	tampered := challenge[:len(challenge)-1] + "0"
+	if strings.HasSuffix(challenge, "0") {
+		tampered = challenge[:len(challenge)-1] + "1"
+	}
+
+	if other.Use(challenge) {
+		t.Error("Use() on a different instance = true, want false")
+	}
+	if uc.Use(tampered) {
+		t.Error("Use() with tampered challenge = true, want false")
+	}
+	if uc.Use("") || uc.Use("not hex") {
+		t.Error("Use() with malformed challenge = true, want false")
+	}
+	if !uc.Use(challenge) {
+		t.Error("Use() = false, want true")
+	}
+	if uc.Use(challenge) {
+		t.Error("Use() again = true, want false")
+	}
+
+	// challenges do not need to be stored
+	for range 2 * minChallengeSweep {
+		if _, err := uc.Issue(); err != nil {
+			t.Fatalf("Issue() error = %v", err)
+		}
+	}
+	if len(uc.used) != 1 {
+		t.Errorf("remembered %d used challenges, want 1", len(uc.used))
+	}
+}
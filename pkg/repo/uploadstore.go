@@ -0,0 +1,154 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// spellchecker:words userkeys
+
+// upload is a set of keys registered with UploadableKeys
+type upload struct {
+	Keys    []Key
+	Created time.Time // time the keys were registered
+
+	// Expires and Token are only set for persistent uploads.
+	Expires time.Time // time the keys expire
+	Token   string    // hash of the token to revoke the keys with, see hashUploadToken
+	Client  string    // client that registered the keys, see UploadableKeys.uploadClient
+}
+
+// Persistent checks if this upload is persistent
+func (u upload) Persistent() bool {
+	return !u.Expires.IsZero()
+}
+
+// Expired checks if this upload has expired at the given time
+func (u upload) Expired(now time.Time) bool {
+	return u.Persistent() && now.After(u.Expires)
+}
+
+// newUploadToken generates a new random token to revoke an upload with
+func newUploadToken() (string, error) {
+	var token [32]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token[:]), nil
+}
+
+// hashUploadToken returns the hash of token stored along with an upload.
+// Only hashes are stored, so that the store can not be used to revoke uploads.
+func hashUploadToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// uploadStoreFile is the json representation of a store file
+type uploadStoreFile struct {
+	Uploads []uploadStoreEntry `json:"uploads"`
+}
+
+// uploadStoreEntry is the json representation of a persistent upload
+type uploadStoreEntry struct {
+	User    string    `json:"user"`
+	Keys    []string  `json:"keys"` // in authorized_keys format
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Token   string    `json:"token"`
+	Client  string    `json:"client,omitempty"`
+}
+
+// readUploadStore reads all persistent uploads from the store at path.
+// When the store does not exist, returns no uploads.
+func readUploadStore(path string) (map[string]upload, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read upload store")
+	}
+
+	var file uploadStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, errors.Wrap(err, "failed to parse upload store")
+	}
+
+	uploads := make(map[string]upload, len(file.Uploads))
+	for _, entry := range file.Uploads {
+		keys := make([]Key, 0, len(entry.Keys))
+		for _, line := range entry.Keys {
+			key, err := parseUploadKey(line)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse key of %q in upload store", entry.User)
+			}
+			keys = append(keys, key)
+		}
+
+		uploads[entry.User] = upload{
+			Keys:    keys,
+			Created: entry.Created,
+			Expires: entry.Expires,
+			Token:   entry.Token,
+			Client:  entry.Client,
+		}
+	}
+	return uploads, nil
+}
+
+// writeUploadStore atomically writes the persistent uploads among uploads to the store at path.
+func writeUploadStore(path string, uploads map[string]upload) error {
+	file := uploadStoreFile{Uploads: []uploadStoreEntry{}}
+	for user, upload := range uploads {
+		if !upload.Persistent() {
+			continue
+		}
+
+		keys := make([]string, len(upload.Keys))
+		for i, key := range upload.Keys {
+			keys[i] = string(bytes.TrimSuffix(key.MarshalAuthorizedKey(), []byte("\n")))
+		}
+
+		file.Uploads = append(file.Uploads, uploadStoreEntry{
+			User:    user,
+			Keys:    keys,
+			Created: upload.Created,
+			Expires: upload.Expires,
+			Token:   upload.Token,
+			Client:  upload.Client,
+		})
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	// write into a temporary file, then rename it into place
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to write upload store")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write upload store")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write upload store")
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "failed to write upload store")
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package repo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_readUploadStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uploads.json")
+
+	data, err := json.Marshal(uploadStoreFile{Uploads: []uploadStoreEntry{
+		{User: "uploaded-alice", Keys: []string{`command="/bin/sh" ` + sshsigTestEd25519Key}, Token: "token"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	uploads, err := readUploadStore(path)
+	if err != nil {
+		t.Fatalf("readUploadStore() error = %v", err)
+	}
+	keys := uploads["uploaded-alice"].Keys
+	if len(keys) != 1 {
+		t.Fatalf("readUploadStore() returned %d keys, want 1", len(keys))
+	}
+	if keys[0].Options != nil {
+		t.Errorf("readUploadStore() options = %v, want none", keys[0].Options)
+	}
+}
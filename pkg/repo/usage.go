@@ -0,0 +1,37 @@
+package repo
+
+import "context"
+
+// Usage describes what the keys returned by a KeyRepository will be used for.
+type Usage int
+
+const (
+	// UsageAuthentication indicates keys used to authenticate users, e.g. in an authorized_keys file.
+	// This is the default.
+	UsageAuthentication Usage = iota
+
+	// UsageSigning indicates keys used to sign data, e.g. git commits.
+	UsageSigning
+)
+
+// userKey identifies the keys of a user for a specific usage
+type userKey struct {
+	Usage    Usage
+	Username string
+}
+
+// usageKey is the context key used to store a Usage
+type usageKey struct{}
+
+// WithUsage returns a copy of ctx that requests keys for the provided usage.
+// A KeyRepository that stores different keys for different usages should consult UsageFromContext.
+func WithUsage(ctx context.Context, usage Usage) context.Context {
+	return context.WithValue(ctx, usageKey{}, usage)
+}
+
+// UsageFromContext returns the usage requested by ctx.
+// When no usage has been requested, returns UsageAuthentication.
+func UsageFromContext(ctx context.Context) Usage {
+	usage, _ := ctx.Value(usageKey{}).(Usage)
+	return usage
+}
@@ -0,0 +1,137 @@
+package akhttpd
+
+import (
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// spellchecker:words akhttpd netip
+
+// RateLimit limits the rate of requests made by every client using a token bucket.
+//
+// Clients are identified by their ip address, see TrustedProxies.ClientIP.
+// Clients within the same network share a bucket, see IPv4Prefix and IPv6Prefix.
+// Requests whose client can not be determined are never limited.
+//
+// The zero value limits all requests, at least Rate and Burst should be set.
+// RateLimit is safe for concurrent access.
+type RateLimit struct {
+	Rate  float64 // number of requests per second a client may make on average
+	Burst int     // number of requests a client may make at once
+
+	// IPv4Prefix and IPv6Prefix are the prefix lengths of networks sharing a bucket.
+	// When zero, they default to 32 (a single address) and 64 (a typical end-user network) respectively.
+	IPv4Prefix, IPv6Prefix int
+
+	Allowed []netip.Prefix // networks that are never limited
+	Proxies TrustedProxies // used to determine the client of a request
+
+	lock      sync.Mutex
+	buckets   map[netip.Prefix]*rateBucket
+	nextSweep int // number of buckets at which to next remove full buckets
+}
+
+// rateBucket is the token bucket of a single network
+type rateBucket struct {
+	tokens float64   // number of available tokens
+	time   time.Time // time tokens was last updated
+}
+
+// minRateSweep is the minimum number of buckets before RateLimit removes full buckets
+const minRateSweep = 64
+
+// Allow checks if the client making r may make another request costing n tokens, and if so takes them from its bucket.
+// When the client may not, returns the time at which it may make the request.
+//
+// Requests costing more than Burst tokens are allowed once the bucket is full, and leave the bucket in debt.
+// A nil RateLimit allows all requests.
+func (rl *RateLimit) Allow(r *http.Request, n int) (ok bool, retry time.Time) {
+	if rl == nil {
+		return true, time.Time{}
+	}
+
+	network, ok := rl.network(r)
+	if !ok {
+		return true, time.Time{}
+	}
+
+	now := time.Now()
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if rl.buckets == nil {
+		rl.buckets = make(map[netip.Prefix]*rateBucket)
+	}
+
+	bucket, ok := rl.buckets[network]
+	if !ok {
+		rl.sweep(now)
+		bucket = &rateBucket{tokens: float64(rl.Burst), time: now}
+		rl.buckets[network] = bucket
+	}
+	rl.refill(bucket, now)
+
+	needed := float64(max(min(n, rl.Burst), 1))
+	if bucket.tokens < needed {
+		if rl.Rate <= 0 {
+			return false, now
+		}
+		wait := time.Duration((needed - bucket.tokens) / rl.Rate * float64(time.Second))
+		return false, now.Add(wait)
+	}
+
+	bucket.tokens -= float64(n)
+	return true, time.Time{}
+}
+
+// network returns the network whose bucket is used for r.
+// When r should not be limited, returns false.
+func (rl *RateLimit) network(r *http.Request) (netip.Prefix, bool) {
+	addr, err := netip.ParseAddr(rl.Proxies.ClientIP(r))
+	if err != nil || containsAddr(rl.Allowed, addr) {
+		return netip.Prefix{}, false
+	}
+
+	bits := rl.IPv6Prefix
+	if bits == 0 {
+		bits = 64
+	}
+	if addr.Is4() {
+		bits = rl.IPv4Prefix
+		if bits == 0 {
+			bits = 32
+		}
+	}
+
+	network, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return network, true
+}
+
+// refill adds the tokens accumulated since bucket was last updated.
+// The caller must hold the lock.
+func (rl *RateLimit) refill(bucket *rateBucket, now time.Time) {
+	bucket.tokens = min(bucket.tokens+now.Sub(bucket.time).Seconds()*rl.Rate, float64(rl.Burst))
+	bucket.time = now
+}
+
+// sweep removes all buckets that have been refilled completely, as they are identical to new buckets.
+// To avoid scanning all buckets on every call, this only happens whenever the number of buckets has grown sufficiently.
+// The caller must hold the lock.
+func (rl *RateLimit) sweep(now time.Time) {
+	if len(rl.buckets) < rl.nextSweep {
+		return
+	}
+	for network, bucket := range rl.buckets {
+		rl.refill(bucket, now)
+		if bucket.tokens >= float64(rl.Burst) {
+			delete(rl.buckets, network)
+		}
+	}
+	rl.nextSweep = max(2*len(rl.buckets), minRateSweep)
+}
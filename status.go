@@ -0,0 +1,51 @@
+package akhttpd
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tkw1536/akhttpd/pkg/repo"
+)
+
+// spellchecker:words akhttpd
+
+// Status is an http.Handler that reports the state of upstream APIs as json.
+type Status struct {
+	GitHub *repo.GitHubKeys // if non-nil, report the rate limit of the GitHub API
+}
+
+// statusContext is the json response sent by Status
+type statusContext struct {
+	GitHub *githubStatus `json:"github,omitempty"`
+}
+
+type githubStatus struct {
+	RateLimit repo.RateLimit `json:"rate_limit"`
+	Exhausted bool           `json:"exhausted"`
+}
+
+// ServeHTTP serves the current status as json.
+func (s Status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Add("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var context statusContext
+	if s.GitHub != nil {
+		rate := s.GitHub.RateLimit()
+		context.GitHub = &githubStatus{
+			RateLimit: rate,
+			Exhausted: rate.Exhausted(time.Now()),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(context); err != nil {
+		log.Printf("%s: %s", r.URL.Path, err)
+	}
+}
@@ -0,0 +1,57 @@
+package akhttpd
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// spellchecker:words akhttpd
+
+// statusWriter is an http.ResponseWriter that wraps an underlying ResponseWriter.
+// It records the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+
+	status int
+}
+
+// WriteHeader records the status code and writes it into the underlying ResponseWriter.
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes b into the underlying ResponseWriter.
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Status returns the status code written so far.
+// If nothing has been written, returns http.StatusOK.
+func (sw *statusWriter) Status() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
+
+// Unwrap returns the underlying ResponseWriter, for use with http.ResponseController.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// Hijack hijacks the underlying connection, see http.Hijacker.
+// A hijacked connection is recorded with status http.StatusSwitchingProtocols.
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(sw.ResponseWriter).Hijack()
+	if err == nil && sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}